@@ -0,0 +1,159 @@
+package gosses
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// A format of directory downloads.
+type archiveFormat struct {
+	// Appended to the name of the archive.
+	ext         string
+	contentType string
+	create      func(storage Storage, w io.Writer) (archiveWriter, error)
+}
+
+// The formats of directory downloads, by the value of the format query parameter.
+var archiveFormats = map[string]archiveFormat{
+	"zip": {".zip", "application/zip", func(storage Storage, w io.Writer) (archiveWriter, error) {
+		return &zipArchive{storage: storage, writer: zip.NewWriter(w)}, nil
+	}},
+	"tar": {".tar", "application/x-tar", func(storage Storage, w io.Writer) (archiveWriter, error) {
+		return &tarArchive{storage: storage, writer: tar.NewWriter(w)}, nil
+	}},
+	"tar.gz": {".tar.gz", "application/gzip", func(storage Storage, w io.Writer) (archiveWriter, error) {
+		compressor := gzip.NewWriter(w)
+		return &tarArchive{storage: storage, writer: tar.NewWriter(compressor), compressor: compressor}, nil
+	}},
+	"tar.zst": {".tar.zst", "application/zstd", func(storage Storage, w io.Writer) (archiveWriter, error) {
+		compressor, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{storage: storage, writer: tar.NewWriter(compressor), compressor: compressor}, nil
+	}},
+}
+
+// Writes the entries of a directory download to the response as they are walked.
+type archiveWriter interface {
+	// Adds the file at path in the share as name, described by info.
+	add(name string, path string, info fs.FileInfo) error
+	Close() error
+}
+
+// Adds the directory at dirPath to archive, with all entries placed under baseName.
+func (s *Server) archiveDir(archive archiveWriter, dirPath string, baseName string) error {
+	return s.walk(dirPath, func(path string, f fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.opts.SkipHidden && strings.HasPrefix(f.Name(), ".") {
+			if f.IsDir() {
+				return filepath.SkipDir
+			} else {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		// make the paths consistent between OSes
+		return archive.add(filepath.ToSlash(filepath.Join(baseName, rel)), path, f)
+	})
+}
+
+// A ZIP archive, created with no compression (Store) to avoid any performance impact.
+type zipArchive struct {
+	storage Storage
+	writer  *zip.Writer
+}
+
+func (a *zipArchive) add(name string, path string, info fs.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+	headerWriter, err := a.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		// no data needs to be written to directory
+		return nil
+	}
+	file, err := a.storage.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(headerWriter, file)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.writer.Close()
+}
+
+// A tarball, which keeps the permissions, modification times and symlinks of files unlike ZIP archives.
+type tarArchive struct {
+	storage Storage
+	writer  *tar.Writer
+	// Compresses the tarball if not nil, closed after writer.
+	compressor io.WriteCloser
+}
+
+func (a *tarArchive) add(name string, path string, info fs.FileInfo) error {
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = a.storage.Readlink(path); err != nil {
+			return err
+		}
+	} else if !info.IsDir() && !info.Mode().IsRegular() {
+		// devices, pipes and sockets have nothing to download
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// the owners on the server mean nothing to whoever extracts the archive
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err := a.writer.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	file, err := a.storage.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// the header is already written, a file that grew since the walk is cut short
+	_, err = io.CopyN(a.writer, file, header.Size)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	err := a.writer.Close()
+	if a.compressor != nil {
+		if closeErr := a.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package gosses
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	scratch := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, "中文", ".hidden"), 0755))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "中文", "檔案.html"), []byte("hello"), 0640))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "中文", ".hidden", "secret.txt"), []byte("secret"), 0644))
+	dieMaybe(t, os.Chtimes(filepath.Join(scratch, "中文", "檔案.html"), mtime, mtime))
+	// TODO: Symlinking will fail on Windows unless run as Administrator.
+	dieMaybe(t, os.Symlink("檔案.html", filepath.Join(scratch, "中文", "link")))
+
+	fmt.Println("========== testing tarballs ============")
+	autoServe(t, Options{Root: scratch, SkipHidden: true}, func(url string) {
+		url += "/zip?zipPath=%2F%E4%B8%AD%E6%96%87&zipName=archive&format="
+		decompressors := map[string]func(io.Reader) (io.Reader, error){
+			"tar": func(r io.Reader) (io.Reader, error) {
+				return r, nil
+			},
+			"tar.gz": func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+			"tar.zst": func(r io.Reader) (io.Reader, error) {
+				return zstd.NewReader(r)
+			},
+		}
+		for format, decompress := range decompressors {
+			resp, err := http.Get(url + format)
+			dieMaybe(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			dieMaybe(t, err)
+			if disposition := resp.Header.Get("Content-Disposition"); disposition != `attachment; filename="archive.`+format+`"` {
+				t.Fatal("wrong file name", disposition)
+			}
+			reader, err := decompress(bytes.NewReader(body))
+			dieMaybe(t, err)
+			headers := map[string]*tar.Header{}
+			tarReader := tar.NewReader(reader)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				dieMaybe(t, err)
+				headers[header.Name] = header
+				if header.Name == "中文/檔案.html" {
+					if content, _ := ioutil.ReadAll(tarReader); string(content) != "hello" {
+						t.Fatal("wrong content", format, string(content))
+					}
+				}
+			}
+			if len(headers) != 3 || headers["中文/"] == nil || headers["中文/"].Typeflag != tar.TypeDir {
+				t.Fatal("wrong entries", format, headers)
+			}
+			if file := headers["中文/檔案.html"]; file == nil || file.Mode != 0640 || !file.ModTime.Equal(mtime) {
+				t.Fatal("wrong file", format, file)
+			}
+			if link := headers["中文/link"]; link == nil || link.Typeflag != tar.TypeSymlink || link.Linkname != "檔案.html" {
+				t.Fatal("wrong symlink", format, link)
+			}
+		}
+		if resp, err := http.Get(url + "rar"); err != nil || resp.StatusCode != 400 {
+			t.Fatal("unknown format accepted", resp, err)
+		}
+	})
+}
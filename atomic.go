@@ -0,0 +1,93 @@
+package gosses
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix of the hidden files uploads are written to before being renamed into place.
+	tempFilePrefix = ".gosses-upload-"
+	// Temporary files written this long before startup may still belong to an upload, and aren't swept.
+	tempFileSweepMargin = time.Minute
+)
+
+// Aborts background work once the server is closed.
+var errStopped = errors.New("server stopped")
+
+// Writes a file through a temporary file in the same directory, so that readers never see it half-written
+// and a failed write leaves any previous version untouched. The temporary file is removed if write fails.
+// The finished file is renamed to dstPath, or moved by place if it isn't nil.
+func writeAtomic(storage Storage, dstPath string, write func(file File) error, place func(tempPath string) error) error {
+	file, err := storage.CreateTemp(filepath.Dir(dstPath), tempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	defer storage.Remove(tempPath)
+	defer file.Close()
+	if err := write(file); err != nil {
+		return err
+	}
+	// temporary files are created private
+	if err := file.Chmod(uploadMode(storage, dstPath)); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if place != nil {
+		return place(tempPath)
+	}
+	return storage.Rename(tempPath, dstPath)
+}
+
+// Returns the mode of an upload to dstPath, which keeps the mode of a replaced file.
+func uploadMode(storage Storage, dstPath string) fs.FileMode {
+	if stat, err := storage.Stat(dstPath); err == nil {
+		return stat.Mode().Perm()
+	}
+	return 0644
+}
+
+// Removes temporary files left behind by uploads interrupted by a crash or restart. It runs in the background
+// alongside new uploads, so only files last written before startup are removed.
+func (s *Server) sweepTempFiles(startup time.Time) {
+	defer s.background.Done()
+	before := startup.Add(-tempFileSweepMargin)
+	mounts := s.mounts
+	if s.root != nil {
+		mounts = []Mount{*s.root}
+	}
+	for _, mount := range mounts {
+		if !s.writable(&mount) {
+			continue
+		}
+		err := s.storage.Walk(mount.Path, false, func(path string, info fs.FileInfo, err error) error {
+			select {
+			case <-s.stop:
+				return errStopped
+			default:
+			}
+			if err != nil || info.IsDir() || !strings.HasPrefix(info.Name(), tempFilePrefix) ||
+				!info.ModTime().Before(before) {
+				return nil
+			}
+			if err := s.storage.Remove(path); err != nil {
+				s.opts.Logger.Warn().Err(err).Str("path", path).Msg("failed to remove leftover upload")
+			} else {
+				s.opts.Logger.Info().Str("path", path).Msg("removed leftover upload")
+			}
+			return nil
+		})
+		if err == errStopped {
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package gosses
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAtomicUpload(t *testing.T) {
+	scratch := t.TempDir()
+	leftover := filepath.Join(scratch, tempFilePrefix+"123")
+	dieMaybe(t, os.WriteFile(leftover, []byte("partial"), 0600))
+	crashed := time.Now().Add(-time.Hour)
+	dieMaybe(t, os.Chtimes(leftover, crashed, crashed))
+	ongoing := filepath.Join(scratch, tempFilePrefix+"456")
+	dieMaybe(t, os.WriteFile(ongoing, []byte("partial"), 0600))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "a.txt"), []byte("original"), 0640))
+	opts := Options{Root: scratch, MaxUploadSize: 10}
+	fmt.Println("========== testing atomic uploads ============")
+	server, err := New(opts)
+	dieMaybe(t, err)
+	// the sweep runs in the background
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(leftover); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dieMaybe(t, server.Close())
+	if _, err := os.Stat(leftover); err == nil {
+		t.Fatal("leftover upload not swept")
+	}
+	if _, err := os.Stat(ongoing); err != nil {
+		t.Fatal("ongoing upload swept")
+	}
+	dieMaybe(t, os.Remove(ongoing))
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		if postDummyFile(t, url, "%2Fa.txt", strings.Repeat("x", 11)) == `ok` {
+			t.Fatal("upload over limit passed")
+		}
+		if get(t, url+"a.txt") != `original` {
+			t.Fatal("failed upload replaced file")
+		}
+		if postDummyFile(t, url, "%2Fa.txt", "replaced") != `ok` || get(t, url+"a.txt") != `replaced` {
+			t.Fatal("upload failed")
+		}
+		stat, err := os.Stat(filepath.Join(scratch, "a.txt"))
+		dieMaybe(t, err)
+		if stat.Mode().Perm() != 0640 {
+			t.Fatal("mode of replaced file lost", stat.Mode())
+		}
+		files, err := os.ReadDir(scratch)
+		dieMaybe(t, err)
+		if len(files) != 1 {
+			t.Fatal("temporary files left behind", len(files))
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package gosses
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Compared against when the username is unknown, so failed logins take the same time either way.
+// Generated on first use to not slow down importing the package.
+var dummyHash []byte
+var dummyHashOnce sync.Once
+
+// LoadUsers loads an htpasswd-compatible file with one 'username:hash' entry per line, for Options.Users.
+// Only bcrypt hashes are supported, as generated by 'htpasswd -B'.
+func LoadUsers(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'username:hash'", path, lineNum)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: user '%s' does not have a bcrypt hash", path, lineNum, parts[0])
+		}
+		result[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, errors.New(path + ": no users defined")
+	}
+	return result, nil
+}
+
+// Checks the password of username against the loaded users.
+func (s *Server) checkPassword(username string, password string) bool {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	if _, ok := s.verifiedLogins.Load(key); ok {
+		return true
+	}
+	hash, ok := s.opts.Users[username]
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gosses"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	s.verifiedLogins.Store(key, struct{}{})
+	return true
+}
+
+// Requires HTTP basic authentication if users are configured.
+// Profiles without users only log in over SFTP, and must not let anyone in over HTTP with every permission.
+func (s *Server) authChecker(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.opts.Users == nil && s.opts.Profiles == nil {
+			return handlerFunc(c)
+		}
+		username, password, ok := c.Request().BasicAuth()
+		if ok && s.checkPassword(username, password) {
+			c.Set("user", username)
+			return handlerFunc(c)
+		}
+		if ok {
+			s.opts.Logger.Warn().Str("user", username).Str("remote_ip", c.RealIP()).Msg("failed login")
+		}
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="gosses", charset="UTF-8"`)
+		return c.String(401, "error")
+	}
+}
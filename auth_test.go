@@ -0,0 +1,64 @@
+package gosses
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getWithAuth(t *testing.T, url string, username string, password string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	dieMaybe(t, err)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	dieMaybe(t, err)
+	return resp.StatusCode, trimSpaces(string(body))
+}
+
+func TestAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dieMaybe(t, err)
+	usersPath := filepath.Join(t.TempDir(), "htpasswd")
+	dieMaybe(t, os.WriteFile(usersPath, []byte("# comment\nalice:"+string(hash)+"\n"), 0600))
+	users, err := LoadUsers(usersPath)
+	dieMaybe(t, err)
+
+	fmt.Println("========== testing authentication ============")
+	autoServe(t, Options{Root: "test-fixture", SkipHidden: true, Users: users}, func(url string) {
+		url += "/"
+		if status, _ := getWithAuth(t, url, "", ""); status != 401 {
+			t.Fatal("anonymous request passed", status)
+		}
+		if status, _ := getWithAuth(t, url, "alice", "wrong"); status != 401 {
+			t.Fatal("wrong password passed", status)
+		}
+		if status, _ := getWithAuth(t, url, "bob", "secret"); status != 401 {
+			t.Fatal("unknown user passed", status)
+		}
+		if status, _ := getWithAuth(t, url+"zip?zipPath=%2Fhols&zipName=hols", "", ""); status != 401 {
+			t.Fatal("anonymous zip passed", status)
+		}
+		status, body := getWithAuth(t, url, "alice", "secret")
+		if status != 200 || !strings.Contains(body, `href="hols">hols/</a>`) {
+			t.Fatal("valid login failed", status)
+		}
+	})
+}
+
+func TestAuthInvalidFile(t *testing.T) {
+	usersPath := filepath.Join(t.TempDir(), "htpasswd")
+	dieMaybe(t, os.WriteFile(usersPath, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600))
+	if _, err := LoadUsers(usersPath); err == nil {
+		t.Fatal("non-bcrypt hash accepted")
+	}
+}
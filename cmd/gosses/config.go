@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/ViRb3/gosses"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefix of the environment variables that override the configuration file.
+const envPrefix = "GOSSES_"
+
+// The setting holding the paths to share, which are positional arguments on the command line.
+// Multiple paths are given as a list in configuration files, or separated like PATH in the environment.
+const pathSetting = "path"
+
+// Long names of the single-letter flags, used in configuration files and environment variables.
+var settingAliases = map[string]string{
+	"host":        "h",
+	"port":        "p",
+	"skip-hidden": "k",
+	"read-only":   "ro",
+}
+
+// A setting value and where it came from, to point users at the culprit when it's invalid.
+type setting struct {
+	value  string
+	source string
+}
+
+// Applies the configuration file and GOSSES_* environment variables to all flags not set on the command line.
+// Precedence is file < environment < flags. Returns the paths to share.
+func loadConfig() ([]string, error) {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	settings := map[string]setting{}
+	configPath := *configFile
+	if configPath == "" {
+		configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+	if configPath != "" {
+		fileSettings, err := readConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileSettings {
+			settings[name] = setting{value, configPath}
+		}
+	}
+	for _, name := range append(settingNames(), pathSetting) {
+		envName := envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if value, ok := os.LookupEnv(envName); ok {
+			settings[resolveSetting(name)] = setting{value, envName}
+		}
+	}
+	var sharePaths []string
+	if len(flag.Args()) > 0 {
+		sharePaths = flag.Args()
+	} else if s, ok := settings[pathSetting]; ok {
+		sharePaths = filepath.SplitList(s.value)
+	}
+	delete(settings, pathSetting)
+	for name, s := range settings {
+		if explicit[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("%s: unknown setting '%s'", s.source, name)
+		}
+		// not flag.Set, which would mark the flag as set on the command line
+		if err := f.Value.Set(s.value); err != nil {
+			return nil, fmt.Errorf("%s: invalid value '%s' for %s: %v", s.source, s.value, name, err)
+		}
+	}
+	return sharePaths, nil
+}
+
+// Returns the names of all settings, preferring the long alias of a flag if it has one.
+func settingNames() []string {
+	aliasOf := map[string]string{}
+	for alias, name := range settingAliases {
+		aliasOf[name] = alias
+	}
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		// a configuration file can't point to another one
+		if f.Name == "config" {
+			return
+		}
+		if alias, ok := aliasOf[f.Name]; ok {
+			names = append(names, alias)
+		} else {
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+// Resolves a setting name, as found in a configuration file or environment variable, to its flag name.
+func resolveSetting(name string) string {
+	name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	if alias, ok := settingAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// Reads a flat YAML, TOML or JSON configuration file, depending on its extension.
+// Keys are resolved to flag names and values stringified for the flag parsers.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration format, expected .yaml, .toml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	result := map[string]string{}
+	for key, value := range raw {
+		name := resolveSetting(key)
+		if name != pathSetting && (name == "config" || flag.Lookup(name) == nil) {
+			return nil, fmt.Errorf("%s: unknown setting '%s'", path, key)
+		}
+		switch value := value.(type) {
+		case []interface{}:
+			if name != pathSetting {
+				return nil, fmt.Errorf("%s: setting '%s' must be a single value", path, key)
+			}
+			var paths []string
+			for _, item := range value {
+				paths = append(paths, fmt.Sprint(item))
+			}
+			result[name] = strings.Join(paths, string(os.PathListSeparator))
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: setting '%s' must be a single value", path, key)
+		case nil:
+		default:
+			result[name] = fmt.Sprint(value)
+		}
+	}
+	return result, nil
+}
+
+// Checks the final settings for bad values.
+// Returns a message for each problem found.
+func validateConfig(sharePaths []string) []string {
+	var problems []string
+	if *port < 1 || *port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range 1-65535", *port))
+	}
+	if !strings.HasPrefix(*prefixPath, "/") {
+		problems = append(problems, fmt.Sprintf("prefix '%s' must start with '/'", *prefixPath))
+	}
+	if _, err := gosses.ParseConflictPolicy(*conflict); err != nil {
+		problems = append(problems, err.Error())
+	}
+	names := map[string]bool{}
+	for _, sharePath := range sharePaths {
+		name, sharePath := splitMount(sharePath)
+		if stat, err := os.Stat(sharePath); err != nil {
+			problems = append(problems, fmt.Sprintf("path to share: %v", err))
+		} else if !stat.IsDir() {
+			problems = append(problems, fmt.Sprintf("path to share '%s' is not a directory", sharePath))
+		}
+		if len(sharePaths) > 1 && names[name] {
+			problems = append(problems, fmt.Sprintf("mount name '%s' is used more than once, "+
+				"use 'name=path' to rename it", name))
+		}
+		names[name] = true
+	}
+	for _, name := range splitList(*readOnlyMounts) {
+		if !names[name] {
+			problems = append(problems, fmt.Sprintf("read-only mount '%s' does not exist", name))
+		}
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		problems = append(problems, "both tls-cert and tls-key must be provided")
+	}
+	if *tlsSelfSigned && *tlsCert != "" {
+		problems = append(problems, "tls-self-signed cannot be combined with tls-cert")
+	}
+	if *pageSize < 0 {
+		problems = append(problems, "page-size must not be negative")
+	}
+	if *errorPagesDir != "" {
+		if stat, err := os.Stat(*errorPagesDir); err != nil || !stat.IsDir() {
+			problems = append(problems, fmt.Sprintf("error-pages-dir '%s' is not a directory", *errorPagesDir))
+		}
+	}
+	if *profilesFile != "" && *usersFile == "" && *authorizedKeysFile == "" {
+		problems = append(problems, "perms requires users or authorized-keys")
+	}
+	if *sftpAddr != "" && *usersFile == "" && *authorizedKeysFile == "" {
+		problems = append(problems, "sftp requires users or authorized-keys")
+	}
+	if *s3Path != "" && *s3KeysFile == "" {
+		problems = append(problems, "s3 requires s3-keys")
+	}
+	return problems
+}
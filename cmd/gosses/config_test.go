@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Relative to the package directory, which tests run in.
+const fixturePath = "../../test-fixture"
+
+func dieMaybe(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	oldHost, oldPort, oldReadOnly, oldPrefix := *host, *port, *readOnly, *prefixPath
+	defer func() {
+		*host, *port, *readOnly, *prefixPath = oldHost, oldPort, oldReadOnly, oldPrefix
+		*configFile = ""
+	}()
+
+	for _, name := range []string{"config.yaml", "config.toml", "config.json"} {
+		configPath := filepath.Join(t.TempDir(), name)
+		var content string
+		switch filepath.Ext(name) {
+		case ".yaml":
+			content = "host: 10.0.0.1\nport: 9000\nread-only: true\nprefix: /files\npath: " + fixturePath + "\n"
+		case ".toml":
+			content = "host = \"10.0.0.1\"\nport = 9000\nread_only = true\nprefix = \"/files\"\npath = \"" + fixturePath + "\"\n"
+		case ".json":
+			content = `{"host": "10.0.0.1", "port": 9000, "read-only": true, "prefix": "/files", "path": "` + fixturePath + `"}`
+		}
+		dieMaybe(t, os.WriteFile(configPath, []byte(content), 0600))
+		*configFile = configPath
+		*host, *port, *readOnly, *prefixPath = "127.0.0.1", 8001, false, "/"
+		t.Setenv("GOSSES_PORT", "9001")
+		// flags take precedence over both
+		dieMaybe(t, flag.Set("prefix", "/explicit"))
+
+		sharePaths, err := loadConfig()
+		dieMaybe(t, err)
+		if len(sharePaths) != 1 || sharePaths[0] != fixturePath || *host != "10.0.0.1" || !*readOnly {
+			t.Fatal(name, "configuration file not applied")
+		}
+		if *port != 9001 {
+			t.Fatal(name, "environment variable not applied", *port)
+		}
+		if *prefixPath != "/explicit" {
+			t.Fatal(name, "flag overridden", *prefixPath)
+		}
+		if problems := validateConfig(sharePaths); len(problems) != 0 {
+			t.Fatal(name, problems)
+		}
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	oldPort := *port
+	defer func() {
+		*port = oldPort
+		*configFile = ""
+	}()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	dieMaybe(t, os.WriteFile(configPath, []byte("colour: blue\n"), 0600))
+	*configFile = configPath
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("unknown setting accepted")
+	}
+
+	dieMaybe(t, os.WriteFile(configPath, []byte("port: eighty\n"), 0600))
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("invalid port accepted")
+	}
+
+	*configFile = ""
+	*port = 70000
+	if problems := validateConfig([]string{filepath.Join(fixturePath, "b.txt")}); len(problems) != 2 {
+		t.Fatal("expected port and path problems", problems)
+	}
+
+	*port = 8001
+	if problems := validateConfig([]string{fixturePath + "/hols", fixturePath + "/subdir/../hols"}); len(problems) != 1 {
+		t.Fatal("expected duplicate mount name problem", problems)
+	}
+}
+
+func TestConfigMounts(t *testing.T) {
+	defer func() {
+		*configFile = ""
+	}()
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "path:\n  - photos=" + fixturePath + "/hols\n  - " + fixturePath + "/subdir\n"
+	dieMaybe(t, os.WriteFile(configPath, []byte(content), 0600))
+	*configFile = configPath
+	sharePaths, err := loadConfig()
+	dieMaybe(t, err)
+	if len(sharePaths) != 2 {
+		t.Fatal("expected two paths", sharePaths)
+	}
+	if name, path := splitMount(sharePaths[0]); name != "photos" || path != fixturePath+"/hols" {
+		t.Fatal("named mount not split", name, path)
+	}
+	if name, _ := splitMount(sharePaths[1]); name != "subdir" {
+		t.Fatal("mount not named after directory", name)
+	}
+}
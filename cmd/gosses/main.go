@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ViRb3/gosses"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var configFile = flag.String("config", "", "Configuration file (.yaml, .toml or .json). "+
+	"Settings are named after the flags, e.g. 'read-only', and can be overridden by GOSSES_* environment variables")
+var host = flag.String("h", "127.0.0.1", "Host to listen to, empty for all")
+var port = flag.Int("p", 8001, "Port to listen to")
+var prefixPath = flag.String("prefix", "/", "Url prefix at which gosses can be reached")
+var symlinks = flag.Bool("symlinks", false, "Follow symlinks. "+
+	"\033[4mWARNING\033[0m: symlinks will by nature allow escaping the shared path")
+var skipHidden = flag.Bool("k", true, "Skip files prefixed with '.'")
+var precompressed = flag.Bool("precompressed", false, "Serve precompressed .br, .zst and .gz copies of files "+
+	"to clients that accept them")
+var hidePrecompressed = flag.Bool("hide-precompressed", false, "Hide precompressed copies from listings")
+var compress = flag.Bool("compress", false, "Compress listings and text files with gzip, brotli or zstd")
+var mimeTypesFiles = flag.String("mime-types", "", "Comma-separated Apache .types files mapping extensions "+
+	"to the Content-Type to serve them with")
+var errorPages = flag.Bool("error-pages", false, "Show browsers the 403.html, 404.html or 500.html page "+
+	"at the root of the shared path on errors")
+var errorPagesDir = flag.String("error-pages-dir", "", "Directory to take error pages from when the shared path has none")
+var pageSize = flag.Int("page-size", 0, "Number of entries per page of a listing, 0 to list all of them")
+var indexDir = flag.String("index-dir", "", "Directory outside of the shared paths for a full-text search index "+
+	"of text files. Enables full-text search")
+var indexInterval = flag.Duration("index-interval", 10*time.Minute, "How often to update the full-text search index "+
+	"with changes made outside of gosses, negative to never")
+var thumbnailDir = flag.String("thumbnail-dir", "", "Directory outside of the shared paths to cache image thumbnails in. "+
+	"Enables thumbnails")
+var webDAV = flag.String("webdav", "", "Also serve the share over WebDAV at this path under the prefix, e.g. 'dav'")
+var s3Path = flag.String("s3", "", "Also serve the share over an S3-compatible API at this path under the prefix, "+
+	"e.g. 's3'. Requires s3-keys")
+var s3KeysFile = flag.String("s3-keys", "", "File with one 'accessKeyId:secret[:username]' S3 access key per line")
+var readOnly = flag.Bool("ro", false, "Read-only mode. Disable upload, rename, move, etc")
+var readOnlyMounts = flag.String("ro-mounts", "", "Comma-separated names of mounts to share read-only")
+var logJson = flag.Bool("json", false, "Output logs in JSON")
+var usersFile = flag.String("users", "", "htpasswd file with bcrypt hashed users. Enables authentication")
+var profilesFile = flag.String("perms", "", "File granting users permissions and home directories, "+
+	"one 'username:read,upload,mkdir,mv,rm[:home]' per line. Unlisted users get all permissions")
+var sftpAddr = flag.String("sftp", "", "Also serve the share over SFTP on this address, e.g. ':2022'. "+
+	"Requires users or authorized-keys")
+var sftpHostKey = flag.String("sftp-host-key", "", "SSH host key file, generated if missing. "+
+	"Defaults to 'gosses/ssh_host_ed25519_key' in the user config directory")
+var authorizedKeysFile = flag.String("authorized-keys", "", "OpenSSH authorized_keys file for SFTP logins, "+
+	"with the username as the comment of each key")
+var stagingDir = flag.String("staging-dir", "", "Directory for partial resumable uploads, "+
+	"defaults to 'gosses-uploads' in the temporary directory")
+var conflict = flag.String("conflict", "overwrite", "What to do when an upload targets an existing file: "+
+	"overwrite, reject or rename to 'name (1).ext'. Requests can override it")
+var maxUploadSize byteSize
+var maxRPCSize byteSize
+var minFreeSpace byteSize
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file, reloaded from disk when changed")
+var tlsKey = flag.String("tls-key", "", "TLS private key file")
+var tlsSelfSigned = flag.Bool("tls-self-signed", false, "Serve TLS with a generated and cached self-signed certificate for the host")
+
+func init() {
+	flag.Var(&maxUploadSize, "max-upload-size", "Maximum size of an uploaded file, e.g. '10G'. 0 for no limit")
+	flag.Var(&maxRPCSize, "max-rpc-size", "Maximum size of an RPC request body, defaults to 1M")
+	flag.Var(&minFreeSpace, "min-free-space", "Reject uploads that would leave less free disk space than this, e.g. '1G'")
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: gosses [OPTION]... [NAME=]PATH_TO_SHARE...\n")
+		fmt.Printf("       gosses index -index-dir DIR [OPTION]... [NAME=]PATH_TO_SHARE...\n\n")
+		fmt.Printf("Multiple paths are shared as top-level folders, named after the directory or NAME.\n")
+		fmt.Printf("The index command rebuilds the full-text search index and exits.\n\n")
+		flag.PrintDefaults()
+	}
+	args := os.Args[1:]
+	rebuildIndex := len(args) > 0 && args[0] == "index"
+	if rebuildIndex {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	sharePaths, err := loadConfig()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	if len(sharePaths) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *logJson {
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	}
+	if problems := validateConfig(sharePaths); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Error().Msg(problem)
+		}
+		log.Fatal().Msg("invalid configuration")
+	}
+	options := gosses.Options{
+		Prefix:            *prefixPath,
+		Symlinks:          *symlinks,
+		SkipHidden:        *skipHidden,
+		Precompressed:     *precompressed,
+		HidePrecompressed: *hidePrecompressed,
+		Compress:          *compress,
+		ErrorPages:        *errorPages,
+		ErrorPagesDir:     *errorPagesDir,
+		PageSize:          *pageSize,
+		IndexDir:          *indexDir,
+		IndexInterval:     *indexInterval,
+		ThumbnailDir:      *thumbnailDir,
+		WebDAV:            *webDAV,
+		S3:                *s3Path,
+		ReadOnly:          *readOnly,
+		Conflict:          gosses.ConflictPolicy(*conflict),
+		MaxUploadSize:     int64(maxUploadSize),
+		MaxRPCSize:        int64(maxRPCSize),
+		MinFreeSpace:      int64(minFreeSpace),
+		StagingDir:        *stagingDir,
+	}
+	addShares(&options, sharePaths)
+	if *usersFile != "" {
+		if options.Users, err = gosses.LoadUsers(*usersFile); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+	if *profilesFile != "" {
+		if options.Profiles, err = gosses.LoadProfiles(*profilesFile); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+	if *authorizedKeysFile != "" {
+		if options.AuthorizedKeys, err = gosses.LoadAuthorizedKeys(*authorizedKeysFile); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+	if *s3KeysFile != "" {
+		if options.S3Keys, err = gosses.LoadS3Keys(*s3KeysFile); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+	if *mimeTypesFiles != "" {
+		if options.MimeTypes, err = gosses.LoadMimeTypes(splitList(*mimeTypesFiles)...); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+	if rebuildIndex {
+		if *indexDir == "" {
+			log.Fatal().Msg("index requires index-dir")
+		}
+		options.IndexInterval = -1
+	}
+	server, err := gosses.New(options)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	if rebuildIndex {
+		if err := server.RebuildIndex(); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		log.Info().Str("state", "rebuilt full-text search index").Str("dir", *indexDir).Send()
+		return
+	}
+	if *sftpAddr != "" {
+		go serveSFTP(server)
+	}
+	serve(server)
+}
+
+// Shares a single unnamed path as the root, or else every path as a mount.
+func addShares(options *gosses.Options, sharePaths []string) {
+	readOnlyNames := map[string]bool{}
+	for _, name := range splitList(*readOnlyMounts) {
+		readOnlyNames[name] = true
+	}
+	if len(sharePaths) == 1 {
+		if name, path := splitMount(sharePaths[0]); path == sharePaths[0] {
+			options.Root = path
+			options.ReadOnly = options.ReadOnly || readOnlyNames[name]
+			return
+		}
+	}
+	for _, sharePath := range sharePaths {
+		name, path := splitMount(sharePath)
+		options.Mounts = append(options.Mounts, gosses.Mount{Name: name, Path: path, ReadOnly: readOnlyNames[name]})
+	}
+}
+
+// Splits a 'NAME=PATH' argument into its parts. The name defaults to the base name of the path.
+func splitMount(sharePath string) (string, string) {
+	parts := strings.SplitN(sharePath, "=", 2)
+	// a separator before '=' means it's part of the path
+	if len(parts) == 2 && !strings.ContainsAny(parts[0], `/\`) {
+		return parts[0], parts[1]
+	}
+	absPath, err := filepath.Abs(sharePath)
+	if err != nil {
+		return filepath.Base(sharePath), sharePath
+	}
+	return filepath.Base(absPath), sharePath
+}
+
+// Splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Listens for SFTP connections on the configured address until the server fails.
+func serveSFTP(server *gosses.Server) {
+	hostKeyPath := *sftpHostKey
+	if hostKeyPath == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		hostKeyPath = filepath.Join(configDir, "gosses", "ssh_host_ed25519_key")
+	}
+	hostKey, err := gosses.LoadHostKey(hostKeyPath)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	listener, err := net.Listen("tcp", *sftpAddr)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	log.Info().Str("state", "started sftp server").Str("address", *sftpAddr).Send()
+	if err := server.ServeSFTP(listener, hostKey); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+// Listens on the configured address until the server fails.
+func serve(handler http.Handler) {
+	tlsConf, err := tlsConfig()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	httpServer := &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", *host, *port),
+		Handler:   handler,
+		TLSConfig: tlsConf,
+	}
+	if tlsConf != nil {
+		log.Info().Str("state", "started https server").Str("address", httpServer.Addr).Send()
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		log.Info().Str("state", "started http server").Str("address", httpServer.Addr).Send()
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal().Err(err).Send()
+	}
+}
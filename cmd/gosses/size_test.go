@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{"0": 0, "1024": 1024, "512k": 512 << 10, "10G": 10 << 30, "1.5MB": 3 << 19} {
+		var size byteSize
+		dieMaybe(t, size.Set(value))
+		if int64(size) != expected {
+			t.Fatal("wrong size", value, size)
+		}
+	}
+	for _, value := range []string{"", "G", "-1", "10X"} {
+		var size byteSize
+		if size.Set(value) == nil {
+			t.Fatal("invalid size accepted", value)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/rs/zerolog/log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a generated self-signed certificate stays valid.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// Builds the TLS configuration from the command line flags.
+// Returns nil if TLS is disabled.
+func tlsConfig() (*tls.Config, error) {
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if *tlsCert != "" {
+		reloader, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		getCertificate = reloader.GetCertificate
+	} else if *tlsSelfSigned {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := loadOrCreateSelfSigned(filepath.Join(cacheDir, "gosses"), *host)
+		if err != nil {
+			return nil, err
+		}
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	} else {
+		return nil, nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: getCertificate,
+	}, nil
+}
+
+// Serves a certificate and key pair from disk, reloading them whenever either file changes.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Implements tls.Config.GetCertificate.
+// If reloading fails, e.g. because the files are being replaced, the previous certificate is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			log.Error().Err(err).Str("cert", r.certPath).Msg("failed to reload certificate")
+		} else {
+			log.Info().Str("cert", r.certPath).Msg("reloaded certificate")
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) changed() bool {
+	certStat, err := os.Stat(r.certPath)
+	if err != nil {
+		return false
+	}
+	keyStat, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+	return !certStat.ModTime().Equal(r.certMod) || !keyStat.ModTime().Equal(r.keyMod)
+}
+
+func (r *certReloader) reload() error {
+	// stat before reading so a write racing the load is picked up on the next handshake
+	certStat, err := os.Stat(r.certPath)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(r.keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certMod = certStat.ModTime()
+	r.keyMod = keyStat.ModTime()
+	return nil
+}
+
+// Loads a cached self-signed certificate for host from cacheDir.
+// A new one is generated and cached if none exists, or if it expired or doesn't cover host.
+func loadOrCreateSelfSigned(cacheDir string, host string) (*tls.Certificate, error) {
+	name := "selfsigned-" + strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(host)
+	if host == "" {
+		name = "selfsigned-all"
+	}
+	certPath := filepath.Join(cacheDir, name+".crt")
+	keyPath := filepath.Join(cacheDir, name+".key")
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil &&
+			time.Now().Add(24*time.Hour).Before(leaf.NotAfter) && coversHost(leaf, host) {
+			return &cert, nil
+		}
+	}
+	certPEM, keyPEM, err := generateSelfSigned(host)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	log.Info().Str("cert", certPath).Msg("generated self-signed certificate")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func coversHost(leaf *x509.Certificate, host string) bool {
+	if host == "" {
+		host = "localhost"
+	}
+	return leaf.VerifyHostname(host) == nil
+}
+
+// Generates a PEM encoded self-signed certificate and key for host.
+// An empty host, i.e. all interfaces, results in a certificate for localhost.
+func generateSelfSigned(host string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gosses"}, CommonName: host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if host == "" {
+		template.Subject.CommonName = "localhost"
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	} else if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSelfSigned(t *testing.T, dir string, host string, modTime time.Time) {
+	certPEM, keyPEM, err := generateSelfSigned(host)
+	dieMaybe(t, err)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	dieMaybe(t, os.WriteFile(certPath, certPEM, 0644))
+	dieMaybe(t, os.WriteFile(keyPath, keyPEM, 0600))
+	dieMaybe(t, os.Chtimes(certPath, modTime, modTime))
+	dieMaybe(t, os.Chtimes(keyPath, modTime, modTime))
+}
+
+func TestTlsReload(t *testing.T) {
+	dir := t.TempDir()
+	writeSelfSigned(t, dir, "first.example", time.Now().Add(-time.Minute))
+	reloader, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	dieMaybe(t, err)
+
+	cert, err := reloader.GetCertificate(nil)
+	dieMaybe(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	dieMaybe(t, err)
+	if leaf.VerifyHostname("first.example") != nil {
+		t.Fatal("initial certificate not loaded")
+	}
+
+	writeSelfSigned(t, dir, "second.example", time.Now())
+	cert, err = reloader.GetCertificate(nil)
+	dieMaybe(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	dieMaybe(t, err)
+	if leaf.VerifyHostname("second.example") != nil {
+		t.Fatal("certificate not reloaded")
+	}
+}
+
+func TestTlsSelfSignedCache(t *testing.T) {
+	dir := t.TempDir()
+	cert0, err := loadOrCreateSelfSigned(dir, "192.168.100.33")
+	dieMaybe(t, err)
+	cert1, err := loadOrCreateSelfSigned(dir, "192.168.100.33")
+	dieMaybe(t, err)
+	if string(cert0.Certificate[0]) != string(cert1.Certificate[0]) {
+		t.Fatal("self-signed certificate not cached")
+	}
+	leaf, err := x509.ParseCertificate(cert0.Certificate[0])
+	dieMaybe(t, err)
+	if leaf.VerifyHostname("192.168.100.33") != nil {
+		t.Fatal("self-signed certificate does not cover host")
+	}
+}
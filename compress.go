@@ -0,0 +1,156 @@
+package gosses
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this aren't worth compressing.
+const compressMinSize = 1024
+
+// Encodings for dynamic compression, in order of preference.
+var compressEncodings = []string{"br", "zstd", "gzip"}
+
+// Media types worth compressing besides text/*. Media and archives are already compressed.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+	"image/x-icon":           true,
+}
+
+// Compresses responses for clients that accept it, if enabled.
+// Range requests are left alone, as their offsets refer to the uncompressed file.
+func (s *Server) compressor(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !s.opts.Compress || c.Request().Header.Get("Range") != "" {
+			return handlerFunc(c)
+		}
+		accepted := acceptedEncodings(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+		encoding := ""
+		for _, candidate := range compressEncodings {
+			if accepted[candidate] {
+				encoding = candidate
+				break
+			}
+		}
+		if encoding == "" {
+			return handlerFunc(c)
+		}
+		writer := &compressWriter{ResponseWriter: c.Response().Writer, encoding: encoding}
+		c.Response().Writer = writer
+		err := handlerFunc(c)
+		// errors are written later by the error handler, uncompressed
+		c.Response().Writer = writer.ResponseWriter
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// Wraps a response, compressing it once it turns out to be compressible and large enough.
+// Until then, the status and the beginning of the body are held back.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	// Whether the response is left uncompressed, or compressed through encoder.
+	passthrough bool
+	encoder     io.WriteCloser
+	buf         []byte
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	header := w.Header()
+	if status != 200 || header.Get(echo.HeaderContentEncoding) != "" || !isCompressible(header.Get(echo.HeaderContentType)) {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	header.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	if length, err := strconv.ParseInt(header.Get(echo.HeaderContentLength), 10, 64); err == nil && length < compressMinSize {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(data)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	w.buf = append(w.buf, data...)
+	if len(w.buf) < compressMinSize {
+		return len(data), nil
+	}
+	if err := w.startEncoding(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Sends the held back status and starts compressing the body.
+func (w *compressWriter) startEncoding() error {
+	header := w.Header()
+	header.Set(echo.HeaderContentEncoding, w.encoding)
+	header.Del(echo.HeaderContentLength)
+	// ranges of the compressed body can't be served
+	header.Del("Accept-Ranges")
+	w.ResponseWriter.WriteHeader(w.status)
+	switch w.encoding {
+	case "br":
+		w.encoder = brotli.NewWriterLevel(w.ResponseWriter, 4)
+	case "zstd":
+		encoder, err := zstd.NewWriter(w.ResponseWriter, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		w.encoder = encoder
+	default:
+		w.encoder = gzip.NewWriter(w.ResponseWriter)
+	}
+	_, err := w.encoder.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Finishes the response, sending it uncompressed if it stayed too small.
+func (w *compressWriter) Close() error {
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	if w.status == 0 || w.passthrough {
+		return nil
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf)
+	return err
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
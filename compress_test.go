@@ -0,0 +1,74 @@
+package gosses
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	scratch := t.TempDir()
+	text := strings.Repeat("compressible text ", 200)
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "big.txt"), []byte(text), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "small.txt"), []byte("small"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "photo.jpg"), []byte(text), 0644))
+	for i := 0; i < 50; i++ {
+		dieMaybe(t, os.WriteFile(filepath.Join(scratch, fmt.Sprintf("file-%d.txt", i)), nil, 0644))
+	}
+	opts := Options{Root: scratch, Compress: true}
+	fmt.Println("========== testing dynamic compression ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		resp, body := getEncoded(t, url, "gzip")
+		if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatal("listing not compressed", resp.Header)
+		}
+		reader, err := gzip.NewReader(strings.NewReader(body))
+		dieMaybe(t, err)
+		decoded, err := ioutil.ReadAll(reader)
+		dieMaybe(t, err)
+		if !bytes.Contains(decoded, []byte(`href="file-49.txt"`)) {
+			t.Fatal("compressed listing corrupted")
+		}
+
+		resp, body = getEncoded(t, url+"big.txt", "gzip;q=0.5, br")
+		if resp.Header.Get("Content-Encoding") != "br" {
+			t.Fatal("text file not compressed", resp.Header)
+		}
+		decoded, err = ioutil.ReadAll(brotli.NewReader(strings.NewReader(body)))
+		dieMaybe(t, err)
+		if string(decoded) != text {
+			t.Fatal("compressed file corrupted")
+		}
+
+		if resp, body = getEncoded(t, url+"small.txt", "gzip"); resp.Header.Get("Content-Encoding") != "" || body != "small" {
+			t.Fatal("small file compressed", resp.Header)
+		}
+		if resp, _ = getEncoded(t, url+"photo.jpg", "gzip"); resp.Header.Get("Content-Encoding") != "" {
+			t.Fatal("image compressed", resp.Header)
+		}
+		if resp, body = getEncoded(t, url+"big.txt", "identity"); resp.Header.Get("Content-Encoding") != "" || body != text {
+			t.Fatal("encoding not honored", resp.Header)
+		}
+
+		req, err := http.NewRequest("GET", url+"big.txt", nil)
+		dieMaybe(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", "bytes=18-34")
+		resp, err = http.DefaultClient.Do(req)
+		dieMaybe(t, err)
+		defer resp.Body.Close()
+		partial, err := ioutil.ReadAll(resp.Body)
+		dieMaybe(t, err)
+		if resp.StatusCode != 206 || string(partial) != "compressible text" {
+			t.Fatal("range request broken", resp.StatusCode, string(partial))
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package gosses
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when an upload targets a file that already exists.
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite replaces the existing file.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictReject fails the upload with 409 Conflict.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictRename stores the upload under the first free name of the form 'name (1).ext'.
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// Upper bound of the number appended by ConflictRename, so a full directory can't stall an upload.
+const maxRenameAttempts = 10000
+
+var errConflict = echo.NewHTTPError(409, "file already exists")
+
+// ParseConflictPolicy returns the policy with the given name.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictOverwrite, ConflictReject, ConflictRename:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy '%s', expected overwrite, reject or rename", name)
+}
+
+// Returns the policy requested by the gossa-conflict header or the conflict query parameter, or else the default.
+func (s *Server) conflictPolicy(c echo.Context) (ConflictPolicy, error) {
+	name := c.Request().Header.Get("gossa-conflict")
+	if name == "" {
+		name = c.QueryParam("conflict")
+	}
+	if name == "" {
+		return s.opts.Conflict, nil
+	}
+	policy, err := ParseConflictPolicy(name)
+	if err != nil {
+		return "", echo.NewHTTPError(400, err.Error())
+	}
+	return policy, nil
+}
+
+// Returns the path in storage to store a file at according to policy.
+// Callers must hold uploadMu until the file is in place.
+func placeUpload(storage Storage, dstPath string, policy ConflictPolicy) (string, error) {
+	if policy == ConflictOverwrite {
+		return dstPath, nil
+	}
+	if _, err := storage.Lstat(dstPath); errors.Is(err, os.ErrNotExist) {
+		return dstPath, nil
+	} else if err != nil {
+		return "", err
+	}
+	if policy == ConflictReject {
+		return "", errConflict
+	}
+	dir, base := filepath.Split(dstPath)
+	ext := filepath.Ext(base)
+	// a dot file like '.profile' has no extension
+	if ext == base {
+		ext = ""
+	}
+	name := strings.TrimSuffix(base, ext)
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", name, i, ext))
+		if _, err := storage.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", errConflict
+}
+
+// Moves a finished upload at tempPath to dstPath, or to the path placeUpload picks according to policy,
+// and returns where it went. rename moves the file, from the staging directory or inside the share.
+func (s *Server) placeFinished(tempPath string, dstPath string, policy ConflictPolicy,
+	rename func(oldPath string, newPath string) error) (string, error) {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	storedPath, err := placeUpload(s.storage, dstPath, policy)
+	if err != nil {
+		return "", err
+	}
+	return storedPath, rename(tempPath, storedPath)
+}
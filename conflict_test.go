@@ -0,0 +1,109 @@
+package gosses
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConflict(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "a.txt"), []byte("original"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, ".hidden"), []byte("original"), 0644))
+	opts := Options{Root: scratch, Conflict: ConflictReject}
+	fmt.Println("========== testing upload conflicts ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		if postDummyFile(t, url, "%2Fa.txt", "new") != `file already exists` || get(t, url+"a.txt") != `original` {
+			t.Fatal("conflicting upload not rejected")
+		}
+		if postDummyFile(t, url, "%2Fb.txt", "new") != `ok` {
+			t.Fatal("upload without conflict failed")
+		}
+
+		results := postFiles(t, url+"post?conflict=rename", "%2F", [][2]string{{"a.txt", "1"}, {"a.txt", "2"}, {".hidden", "3"}})
+		if results[0].Path != "/a (1).txt" || results[1].Path != "/a (2).txt" || results[2].Path != "/.hidden (1)" {
+			t.Fatal("conflicting uploads not renamed", results)
+		}
+		if get(t, url+"a.txt") != `original` || get(t, url+"a%20(2).txt") != `2` {
+			t.Fatal("renamed upload stored wrong")
+		}
+
+		results = postFiles(t, url+"post?conflict=overwrite", "%2F", [][2]string{{"a.txt", "new"}})
+		if results[0].Path != "/a.txt" || get(t, url+"a.txt") != `new` {
+			t.Fatal("requested overwrite failed", results)
+		}
+
+		metadata := func(path string) string {
+			return "path " + base64.StdEncoding.EncodeToString([]byte(path))
+		}
+		resp := tusRequest(t, "POST", url+"tus/", nil, map[string]string{"Upload-Length": "3", "Upload-Metadata": metadata("/a.txt")})
+		if resp.StatusCode != 409 {
+			t.Fatal("conflicting resumable upload not rejected", resp.StatusCode)
+		}
+		resp = tusRequest(t, "POST", url+"tus/", nil, map[string]string{"Upload-Length": "3", "Upload-Metadata": metadata("/c.txt")})
+		location := resp.Header.Get("Location")
+		if postDummyFile(t, url, "%2Fc.txt", "raced") != `ok` {
+			t.Fatal("upload without conflict failed")
+		}
+		patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+		if resp = tusRequest(t, "PATCH", url+location[1:], []byte("tus"), patch); resp.StatusCode != 409 || get(t, url+"c.txt") != `raced` {
+			t.Fatal("resumable upload replaced a file created meanwhile", resp.StatusCode)
+		}
+		resp = tusRequest(t, "POST", url+"tus/?conflict=rename", nil, map[string]string{"Upload-Length": "3", "Upload-Metadata": metadata("/a.txt")})
+		location = resp.Header.Get("Location")
+		resp = tusRequest(t, "PATCH", url+location[1:], []byte("tus"), patch)
+		if resp.StatusCode != 204 || resp.Header.Get("gossa-path") != "%2Fa%20%283%29.txt" || get(t, url+"a%20(3).txt") != `tus` {
+			t.Fatal("conflicting resumable upload not renamed", resp.StatusCode, resp.Header.Get("gossa-path"))
+		}
+
+		resp, err := http.Post(url+"post?conflict=bogus", "multipart/form-data", nil)
+		dieMaybe(t, err)
+		if resp.StatusCode != 400 {
+			t.Fatal("unknown policy accepted", resp.StatusCode)
+		}
+	})
+
+	fmt.Println("========== testing stored paths with a prefix ============")
+	opts = Options{Root: scratch, Prefix: "/files/", Conflict: ConflictRename}
+	autoServe(t, opts, func(url string) {
+		url += "/files/"
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		_, err := w.CreateFormFile("file", "file")
+		dieMaybe(t, err)
+		dieMaybe(t, w.Close())
+		req, err := http.NewRequest("POST", url+"post", &b)
+		dieMaybe(t, err)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Set("Gossa-Path", "%2Ffiles%2Fb.txt")
+		resp, err := http.DefaultClient.Do(req)
+		dieMaybe(t, err)
+		resp.Body.Close()
+		if storedPath := resp.Header.Get("gossa-path"); storedPath != "%2Ffiles%2Fb%20%281%29.txt" {
+			t.Fatal("wrong stored path of an upload", storedPath)
+		}
+		results := postFiles(t, url+"post", "%2Ffiles%2F", [][2]string{{"b.txt", "multi"}})
+		if results[0].Path != "/files/b (2).txt" {
+			t.Fatal("wrong stored path of a multi-file upload", results)
+		}
+		resp = tusRequest(t, "POST", url+"tus/", nil, map[string]string{
+			"Upload-Length":   "3",
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte("/files/b.txt")),
+		})
+		patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+		resp = tusRequest(t, "PATCH", url+resp.Header.Get("Location")[len("/files/"):], []byte("tus"), patch)
+		if storedPath := resp.Header.Get("gossa-path"); storedPath != "%2Ffiles%2Fb%20%283%29.txt" {
+			t.Fatal("wrong stored path of a resumable upload", resp.StatusCode, storedPath)
+		}
+	})
+
+	if _, err := New(Options{Root: scratch, Conflict: "bogus"}); err == nil {
+		t.Fatal("unknown default policy accepted")
+	}
+}
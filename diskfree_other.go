@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package gosses
+
+import "errors"
+
+// Free space can't be queried on this platform, so the guard is skipped.
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
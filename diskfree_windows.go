@@ -0,0 +1,16 @@
+package gosses
+
+import "golang.org/x/sys/windows"
+
+// Returns the bytes available to the current user on the volume containing path.
+func diskFree(path string) (int64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,93 @@
+package gosses
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errForbidden = echo.NewHTTPError(403, "error")
+var errNotFound = echo.NewHTTPError(404, "error")
+
+// Writes the response for a failed request. Browsers get an error page if there is one,
+// everyone else a plain text message.
+func (s *Server) handleError(err error, c echo.Context) {
+	// the logging middleware has already handled it
+	if c.Response().Committed {
+		return
+	}
+	code, message := 500, "error"
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		code, message = httpErr.Code, fmt.Sprint(httpErr.Message)
+	}
+	if s.serveErrorPage(c, code) {
+		return
+	}
+	c.String(code, message)
+}
+
+// Serves the error page for code, or its precompressed copy, and reports whether there was one.
+func (s *Server) serveErrorPage(c echo.Context, code int) bool {
+	if code != 403 && code != 404 && code != 500 || !s.opts.ErrorPages && s.opts.ErrorPagesDir == "" {
+		return false
+	}
+	// API clients get machine-readable errors
+	if !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/html") {
+		return false
+	}
+	pageName := strconv.Itoa(code) + ".html"
+	for _, dir := range s.errorPageDirs(c) {
+		pagePath := filepath.Join(dir.path, pageName)
+		file, stat, encoding := s.openAcceptedPrecompressed(c, dir.storage, pagePath)
+		if file == nil {
+			var err error
+			if file, err = dir.storage.Open(pagePath); err != nil {
+				continue
+			}
+			if stat, err = file.Stat(); err != nil || !stat.Mode().IsRegular() {
+				file.Close()
+				continue
+			}
+		}
+		defer file.Close()
+		header := c.Response().Header()
+		header.Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		header.Set(echo.HeaderContentLength, strconv.FormatInt(stat.Size(), 10))
+		if encoding != "" {
+			header.Set(echo.HeaderContentEncoding, encoding)
+		}
+		c.Response().WriteHeader(code)
+		if _, err := io.Copy(c.Response(), file); err != nil {
+			s.opts.Logger.Warn().Err(err).Str("path", pagePath).Msg("failed to send error page")
+		}
+		return true
+	}
+	return false
+}
+
+// A directory to look for error pages in, and the storage holding it.
+type errorPageDir struct {
+	storage Storage
+	path    string
+}
+
+// Returns the directories to look for error pages in, in order of preference.
+// Options.ErrorPagesDir is on the local filesystem, unlike the share.
+func (s *Server) errorPageDirs(c echo.Context) []errorPageDir {
+	var dirs []errorPageDir
+	if s.opts.ErrorPages {
+		virtualPath := filepath.Join(s.currentProfile(c).Home, s.cleanPath(c.Request().URL.Path))
+		if mount, _, err := s.findMount(virtualPath); err == nil && mount != nil {
+			dirs = append(dirs, errorPageDir{s.storage, mount.Path})
+		}
+	}
+	if s.opts.ErrorPagesDir != "" {
+		dirs = append(dirs, errorPageDir{LocalStorage{}, s.opts.ErrorPagesDir})
+	}
+	return dirs
+}
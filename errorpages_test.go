@@ -0,0 +1,62 @@
+package gosses
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getPage(t *testing.T, url string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	dieMaybe(t, err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	dieMaybe(t, err)
+	return resp, strings.TrimSpace(string(body))
+}
+
+func TestErrorPages(t *testing.T) {
+	fmt.Println("========== testing error pages ============")
+	autoServe(t, Options{Root: "test-fixture", ErrorPages: true}, func(url string) {
+		url += "/"
+		html := map[string]string{"Accept": "text/html,*/*", "Accept-Encoding": "identity"}
+		resp, body := getPage(t, url+"nothing.txt", html)
+		if resp.StatusCode != 404 || body != `<h1>404</h1>` || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatal("error page not served", resp.StatusCode, body)
+		}
+		html["Accept-Encoding"] = "gzip"
+		resp, body = getPage(t, url+"nothing.txt", html)
+		if resp.StatusCode != 404 || resp.Header.Get("Content-Encoding") != "gzip" || !strings.HasPrefix(body, "\x1f\x8b") {
+			t.Fatal("precompressed error page not served", resp.StatusCode, resp.Header)
+		}
+		if resp, body = getPage(t, url+"nothing.txt", nil); resp.StatusCode != 404 || body != `error` {
+			t.Fatal("api client got an error page", body)
+		}
+	})
+
+	pages := t.TempDir()
+	dieMaybe(t, os.WriteFile(filepath.Join(pages, "404.html"), []byte("lost"), 0644))
+	opts := Options{Mounts: []Mount{{Name: "site", Path: "test-fixture"}, {Name: "photos", Path: filepath.Join("test-fixture", "hols")}}, ErrorPages: true, ErrorPagesDir: pages}
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		html := map[string]string{"Accept": "text/html"}
+		if _, body := getPage(t, url+"site/nothing.txt", html); body != `<h1>404</h1>` {
+			t.Fatal("error page of mount not served", body)
+		}
+		if _, body := getPage(t, url+"photos/nothing.txt", html); body != `lost` {
+			t.Fatal("error page of directory not served", body)
+		}
+		if _, body := getPage(t, url+"nothing/", html); body != `lost` {
+			t.Fatal("error page for unknown mount not served", body)
+		}
+	})
+}
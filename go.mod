@@ -1,12 +1,21 @@
-module gosses
+module github.com/ViRb3/gosses
 
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.1.0
+	github.com/andybalholm/brotli v1.0.4
 	github.com/facebookgo/symwalk v0.0.0-20150726040526-42004b9f3222
+	github.com/klauspost/compress v1.15.1
 	github.com/labstack/echo/v4 v4.7.2
+	github.com/pkg/sftp v1.13.5
 	github.com/rs/zerolog v1.26.1
 	github.com/ziflex/lecho/v2 v2.5.2
+	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -15,14 +24,12 @@ require (
 	github.com/facebookgo/subset v0.0.0-20200203212716-c811ad88dec4 // indirect
 	github.com/facebookgo/testname v0.0.0-20150612200628-5443337c3a12 // indirect
 	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/labstack/gommon v0.3.1 // indirect
 	github.com/mattn/go-colorable v0.1.11 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
-	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e // indirect
-	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f // indirect
-	golang.org/x/sys v0.0.0-20211103235746-7861aae1554b // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
 )
@@ -0,0 +1,508 @@
+package gosses
+
+import (
+	"encoding/gob"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// Name of the index file in Options.IndexDir.
+	indexFileName = "index.gob"
+	// Files larger than this aren't indexed.
+	maxIndexedSize = 10 << 20
+	// Default of Options.IndexInterval.
+	defaultIndexInterval = 10 * time.Minute
+	// How often changes to the index are written to disk.
+	indexSaveInterval = 10 * time.Second
+	// Number of full-text search results returned by default, and at most.
+	defaultTextSearchLimit = 20
+	maxTextSearchLimit     = 100
+)
+
+// Extensions of the text files that are indexed.
+var indexedExts = map[string]bool{
+	"txt": true, "md": true, "markdown": true, "rst": true, "org": true, "tex": true, "log": true, "csv": true,
+	"html": true, "htm": true, "xml": true, "json": true, "yaml": true, "yml": true, "toml": true, "ini": true,
+	"srt": true, "vtt": true,
+	"go": true, "c": true, "h": true, "cpp": true, "hpp": true, "cs": true, "java": true, "kt": true, "swift": true,
+	"rs": true, "py": true, "rb": true, "php": true, "pl": true, "js": true, "ts": true, "jsx": true, "tsx": true,
+	"css": true, "scss": true, "sh": true, "bash": true, "ps1": true, "sql": true, "lua": true, "r": true,
+}
+
+// Markup removed from HTML files before indexing, along with the contents of scripts and styles.
+var htmlTags = regexp.MustCompile(`(?is)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+
+// An inverted index of the words in the text files of every mount, kept in Options.IndexDir.
+// Documents are identified by their virtual path, as seen by users without a home directory.
+type textIndex struct {
+	mu    sync.RWMutex
+	dirty bool
+	// Fields below are saved to disk.
+	Docs map[string]*indexedDoc
+	// Maps each word to the documents containing it, and how often.
+	Terms map[string]map[string]int
+}
+
+// A document in the index, with what's needed to notice changes to it and to remove it.
+type indexedDoc struct {
+	ModTime time.Time
+	Size    int64
+	// Number of words.
+	Length int
+	// Distinct words.
+	Terms []string
+}
+
+// A document matching a full-text search.
+type textResult struct {
+	// Path of the document, relative to the root of the current user.
+	Path    string  `json:"path"`
+	Href    string  `json:"href"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{Docs: map[string]*indexedDoc{}, Terms: map[string]map[string]int{}}
+}
+
+// Loads the index from Options.IndexDir, or starts an empty one if there is none yet.
+func (s *Server) loadIndex() error {
+	if err := os.MkdirAll(s.opts.IndexDir, 0700); err != nil {
+		return err
+	}
+	s.index = newTextIndex()
+	file, err := os.Open(filepath.Join(s.opts.IndexDir, indexFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(file).Decode(s.index); err != nil {
+		// a broken index is rebuilt by the next scan
+		s.opts.Logger.Warn().Err(err).Msg("discarded unreadable search index")
+		s.index = newTextIndex()
+	}
+	return nil
+}
+
+// Writes the index to Options.IndexDir if it changed.
+func (s *Server) saveIndex() error {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	if !s.index.dirty {
+		return nil
+	}
+	err := writeAtomic(LocalStorage{}, filepath.Join(s.opts.IndexDir, indexFileName), func(file File) error {
+		return gob.NewEncoder(file).Encode(s.index)
+	}, nil)
+	if err == nil {
+		s.index.dirty = false
+	}
+	return err
+}
+
+// Keeps the index current in the background until the server is closed:
+// rescans the mounts every Options.IndexInterval, and saves changes.
+func (s *Server) runIndexer() {
+	defer s.background.Done()
+	var rescan <-chan time.Time
+	if s.opts.IndexInterval > 0 {
+		s.scanIndex(false)
+		ticker := time.NewTicker(s.opts.IndexInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	save := time.NewTicker(indexSaveInterval)
+	defer save.Stop()
+	for {
+		select {
+		case <-rescan:
+			s.scanIndex(false)
+		case <-save.C:
+		case <-s.stop:
+			return
+		}
+		if err := s.saveIndex(); err != nil {
+			s.opts.Logger.Error().Err(err).Msg("failed to save search index")
+		}
+	}
+}
+
+// RebuildIndex indexes every text file of the share from scratch and saves the result.
+// Requires Options.IndexDir.
+func (s *Server) RebuildIndex() error {
+	if s.index == nil {
+		return errors.New("full-text search is not enabled")
+	}
+	s.scanIndex(true)
+	return s.saveIndex()
+}
+
+// Brings the index up to date with the files on disk.
+// Unless rebuilding, files that haven't changed since they were indexed are skipped.
+func (s *Server) scanIndex(rebuild bool) {
+	seen := map[string]bool{}
+	for _, root := range s.indexRoots() {
+		virtualRoot, rootPath := root[0], root[1]
+		err := s.walk(rootPath, func(filePath string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if filePath != rootPath && s.opts.SkipHidden && strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isIndexable(info) {
+				return nil
+			}
+			rel, err := filepath.Rel(rootPath, filePath)
+			if err != nil {
+				return nil
+			}
+			virtualPath := path.Join(virtualRoot, filepath.ToSlash(rel))
+			seen[virtualPath] = true
+			if !rebuild && !s.index.changed(virtualPath, info) {
+				return nil
+			}
+			s.indexFile(virtualPath, filePath, info)
+			return nil
+		})
+		if err != nil {
+			s.opts.Logger.Warn().Err(err).Str("path", rootPath).Msg("failed to scan for search index")
+		}
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	for virtualPath := range s.index.Docs {
+		if !seen[virtualPath] {
+			s.index.remove(virtualPath)
+		}
+	}
+}
+
+// Returns pairs of the virtual path and the path on disk of each shared directory.
+func (s *Server) indexRoots() [][2]string {
+	if s.root != nil {
+		return [][2]string{{"/", s.root.Path}}
+	}
+	var roots [][2]string
+	for _, mount := range s.mounts {
+		if !s.opts.SkipHidden || !strings.HasPrefix(mount.Name, ".") {
+			roots = append(roots, [2]string{"/" + mount.Name, mount.Path})
+		}
+	}
+	return roots
+}
+
+// Returns the virtual path of a file on disk, if it is in a mount.
+func (s *Server) virtualPathOf(filePath string) (string, bool) {
+	for _, root := range s.indexRoots() {
+		rel, err := filepath.Rel(root[1], filePath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return path.Join(root[0], filepath.ToSlash(rel)), true
+		}
+	}
+	return "", false
+}
+
+// Indexes a file after it was written, if full-text search is enabled.
+func (s *Server) indexChanged(filePath string) {
+	if s.index == nil {
+		return
+	}
+	virtualPath, ok := s.virtualPathOf(filePath)
+	if !ok {
+		return
+	}
+	info, err := s.stat(filePath)
+	if err != nil || !isIndexable(info) || s.opts.SkipHidden && strings.Contains(virtualPath, "/.") {
+		return
+	}
+	s.indexFile(virtualPath, filePath, info)
+}
+
+// Updates the index after a file or directory was moved, if full-text search is enabled.
+func (s *Server) indexMoved(srcPath string, dstPath string) {
+	if s.index == nil {
+		return
+	}
+	srcVirtual, srcOk := s.virtualPathOf(srcPath)
+	dstVirtual, dstOk := s.virtualPathOf(dstPath)
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	for virtualPath, doc := range s.index.Docs {
+		if !srcOk || virtualPath != srcVirtual && !strings.HasPrefix(virtualPath, srcVirtual+"/") {
+			continue
+		}
+		counts := map[string]int{}
+		for _, term := range doc.Terms {
+			counts[term] = s.index.Terms[term][virtualPath]
+		}
+		s.index.remove(virtualPath)
+		if dstOk {
+			s.index.add(dstVirtual+strings.TrimPrefix(virtualPath, srcVirtual), doc, counts)
+		}
+	}
+}
+
+// Removes a deleted file or directory from the index, if full-text search is enabled.
+func (s *Server) indexRemoved(filePath string) {
+	if s.index == nil {
+		return
+	}
+	removedPath, ok := s.virtualPathOf(filePath)
+	if !ok {
+		return
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	for virtualPath := range s.index.Docs {
+		if virtualPath == removedPath || strings.HasPrefix(virtualPath, strings.TrimSuffix(removedPath, "/")+"/") {
+			s.index.remove(virtualPath)
+		}
+	}
+}
+
+// Reads a file and replaces its entry in the index.
+func (s *Server) indexFile(virtualPath string, filePath string, info fs.FileInfo) {
+	text, err := s.readText(filePath)
+	if err != nil {
+		s.opts.Logger.Warn().Err(err).Str("path", filePath).Msg("failed to index file")
+		return
+	}
+	counts := map[string]int{}
+	length := 0
+	for _, token := range tokenize(text) {
+		counts[token]++
+		length++
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	s.index.add(virtualPath, &indexedDoc{ModTime: info.ModTime(), Size: info.Size(), Length: length}, counts)
+}
+
+// Adds a document along with how often it contains each word. Callers must hold the lock.
+func (index *textIndex) add(virtualPath string, doc *indexedDoc, counts map[string]int) {
+	index.remove(virtualPath)
+	doc.Terms = nil
+	for term, count := range counts {
+		if index.Terms[term] == nil {
+			index.Terms[term] = map[string]int{}
+		}
+		index.Terms[term][virtualPath] = count
+		doc.Terms = append(doc.Terms, term)
+	}
+	index.Docs[virtualPath] = doc
+	index.dirty = true
+}
+
+// Removes a document. Callers must hold the lock.
+func (index *textIndex) remove(virtualPath string) {
+	doc, ok := index.Docs[virtualPath]
+	if !ok {
+		return
+	}
+	for _, term := range doc.Terms {
+		delete(index.Terms[term], virtualPath)
+		if len(index.Terms[term]) == 0 {
+			delete(index.Terms, term)
+		}
+	}
+	delete(index.Docs, virtualPath)
+	index.dirty = true
+}
+
+// Reports whether a file changed since it was indexed.
+func (index *textIndex) changed(virtualPath string, info fs.FileInfo) bool {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	doc, ok := index.Docs[virtualPath]
+	return !ok || !doc.ModTime.Equal(info.ModTime()) || doc.Size != info.Size()
+}
+
+// Ranks the documents containing every word of text with BM25, and returns the first limit of them
+// whose path starts with pathPrefix.
+func (index *textIndex) search(text string, pathPrefix string, limit int) ([]textResult, int) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	terms := uniqueTokens(text)
+	if len(terms) == 0 || len(index.Docs) == 0 {
+		return nil, 0
+	}
+	totalLength := 0
+	for _, doc := range index.Docs {
+		totalLength += doc.Length
+	}
+	averageLength := float64(totalLength) / float64(len(index.Docs))
+	scores := map[string]float64{}
+	for i, term := range terms {
+		postings := index.Terms[term]
+		documentCount := float64(len(postings))
+		idf := math.Log(1 + (float64(len(index.Docs))-documentCount+0.5)/(documentCount+0.5))
+		for virtualPath, count := range postings {
+			if !strings.HasPrefix(virtualPath, pathPrefix) {
+				continue
+			}
+			// only documents with every word qualify
+			if _, ok := scores[virtualPath]; i > 0 && !ok {
+				continue
+			}
+			frequency := float64(count)
+			norm := 1.2 * (0.25 + 0.75*float64(index.Docs[virtualPath].Length)/averageLength)
+			scores[virtualPath] += idf * frequency * 2.2 / (frequency + norm)
+		}
+		for virtualPath := range scores {
+			if _, ok := postings[virtualPath]; !ok {
+				delete(scores, virtualPath)
+			}
+		}
+	}
+	var results []textResult
+	for virtualPath, score := range scores {
+		results = append(results, textResult{Path: virtualPath, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total
+}
+
+// Reports whether a file is a text file small enough to be indexed.
+func isIndexable(info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Size() <= maxIndexedSize && indexedExts[extOf(info.Name())] &&
+		!strings.HasPrefix(info.Name(), tempFilePrefix)
+}
+
+// Reads the text of a file, without markup for HTML.
+func (s *Server) readText(filePath string) (string, error) {
+	file, err := s.storage.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	if ext := extOf(filePath); ext == "html" || ext == "htm" {
+		return htmlTags.ReplaceAllString(string(data), " "), nil
+	}
+	return string(data), nil
+}
+
+// Splits text into lower case words of letters and digits.
+func tokenize(text string) []string {
+	var tokens []string
+	for _, token := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len(token) >= 2 && len(token) <= 64 {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func uniqueTokens(text string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, token := range tokenize(text) {
+		if !seen[token] {
+			seen[token] = true
+			result = append(result, token)
+		}
+	}
+	return result
+}
+
+// Returns the passage of a file around the first occurrence of any of the words of text.
+func (s *Server) snippet(filePath string, text string) string {
+	content, err := s.readText(filePath)
+	if err != nil {
+		return ""
+	}
+	var quoted []string
+	for _, token := range uniqueTokens(text) {
+		quoted = append(quoted, regexp.QuoteMeta(token))
+	}
+	pattern, err := regexp.Compile(`(?i)` + strings.Join(quoted, "|"))
+	if err != nil {
+		return ""
+	}
+	location := pattern.FindStringIndex(content)
+	if location == nil {
+		return ""
+	}
+	start, end := location[0]-80, location[1]+80
+	if start < 0 {
+		start = 0
+	}
+	if end > len(content) {
+		end = len(content)
+	}
+	// don't cut multibyte characters in half
+	for start > 0 && !isRuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !isRuneStart(content[end]) {
+		end++
+	}
+	return strings.Join(strings.Fields(content[start:end]), " ")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// Handles a full-text search for the words in the q parameter, below the directory in the path parameter.
+// Returns the documents containing all of them, best matches first, with a passage around the first match.
+func (s *Server) handleFullText(c echo.Context) error {
+	limit := defaultTextSearchLimit
+	if param := c.QueryParam("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 || limit > maxTextSearchLimit {
+			return echo.NewHTTPError(400, "limit must be between 1 and "+strconv.Itoa(maxTextSearchLimit))
+		}
+	}
+	// the index uses the paths of users without a home directory
+	home := path.Join("/", filepath.ToSlash(s.currentProfile(c).Home))
+	dirPath := path.Join(home, filepath.ToSlash(s.cleanPath(c.QueryParam("path"))))
+	results, total := s.index.search(c.QueryParam("q"), strings.TrimSuffix(dirPath, "/")+"/", limit)
+	for i := range results {
+		results[i].Path = path.Join("/", strings.TrimPrefix(results[i].Path, home))
+		if filePath, _, err := s.resolveCleanPath(c, filepath.FromSlash(results[i].Path)); err == nil {
+			results[i].Snippet = s.snippet(filePath, c.QueryParam("q"))
+		}
+		results[i].Href = (&url.URL{Path: s.opts.Prefix + strings.TrimPrefix(results[i].Path, "/")}).EscapedPath()
+	}
+	if results == nil {
+		results = []textResult{}
+	}
+	return c.JSON(200, map[string]interface{}{"total": total, "results": results})
+}
@@ -0,0 +1,133 @@
+package gosses
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fullTextResponse struct {
+	Total   int          `json:"total"`
+	Results []textResult `json:"results"`
+}
+
+func fullText(t *testing.T, url string) fullTextResponse {
+	resp, err := http.Get(url)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	var result fullTextResponse
+	dieMaybe(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result
+}
+
+func TestFullText(t *testing.T) {
+	scratch := t.TempDir()
+	files := map[string]string{
+		"fox.txt":           "The quick brown fox jumps over the lazy dog. The fox runs.",
+		"notes/think.md":    "Quick thinking saves the day",
+		"page.html":         "<p>A brown <b>bear</b></p><script>var fox</script>",
+		"subs/film.srt":     "1\n00:00:01,000 --> 00:00:02,000\nWhere is the brown fox?",
+		"photo.jpg":         "brown fox",
+		".hidden/secret.md": "brown fox",
+	}
+	for name, content := range files {
+		dieMaybe(t, os.MkdirAll(filepath.Dir(filepath.Join(scratch, name)), 0755))
+		dieMaybe(t, os.WriteFile(filepath.Join(scratch, name), []byte(content), 0644))
+	}
+	opts := Options{Root: scratch, SkipHidden: true, IndexDir: filepath.Join(t.TempDir(), "index"), IndexInterval: -1}
+	server, err := New(opts)
+	dieMaybe(t, err)
+	dieMaybe(t, server.RebuildIndex())
+	ts := httptest.NewServer(server)
+	url := ts.URL + "/"
+
+	fmt.Println("========== testing full-text search ============")
+	result := fullText(t, url+"fulltext?q=brown+FOX")
+	if result.Total != 2 || result.Results[0].Path != "/fox.txt" || result.Results[1].Path != "/subs/film.srt" {
+		t.Fatal("wrong results", result)
+	}
+	if result.Results[0].Score <= result.Results[1].Score || result.Results[0].Href != "/fox.txt" {
+		t.Fatal("wrong ranking", result)
+	}
+	if snippet := result.Results[1].Snippet; snippet != "1 00:00:01,000 --> 00:00:02,000 Where is the brown fox?" {
+		t.Fatal("wrong snippet", snippet)
+	}
+	if result = fullText(t, url+"fulltext?q=bear"); result.Total != 1 || result.Results[0].Path != "/page.html" {
+		t.Fatal("html not indexed", result)
+	}
+	if result = fullText(t, url+"fulltext?q=quick&path=%2Fnotes"); result.Total != 1 || result.Results[0].Path != "/notes/think.md" {
+		t.Fatal("path not applied", result)
+	}
+
+	if postDummyFile(t, url, "%2Fnew.txt", "a brown fox appears") != `ok` {
+		t.Fatal("upload failed")
+	}
+	if postJSON(t, url+"rpc", `{"call":"mv","args":["/subs", "/moved"]}`) != `ok` {
+		t.Fatal("mv failed")
+	}
+	if postJSON(t, url+"rpc", `{"call":"rm","args":["/fox.txt"]}`) != `ok` {
+		t.Fatal("rm failed")
+	}
+	result = fullText(t, url+"fulltext?q=brown+fox")
+	if result.Total != 2 || result.Results[0].Path != "/moved/film.srt" && result.Results[1].Path != "/moved/film.srt" {
+		t.Fatal("index not updated", result)
+	}
+	ts.Close()
+	dieMaybe(t, server.Close())
+
+	// the index is kept on disk
+	server, err = New(opts)
+	dieMaybe(t, err)
+	ts = httptest.NewServer(server)
+	if result = fullText(t, ts.URL+"/fulltext?q=appears"); result.Total != 1 || result.Results[0].Path != "/new.txt" {
+		t.Fatal("index not persisted", result)
+	}
+	ts.Close()
+	dieMaybe(t, server.Close())
+
+	// results are relative to the home directory
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dieMaybe(t, err)
+	opts.Users = map[string][]byte{"bob": hash}
+	opts.Profiles = map[string]Profile{"bob": {Perms: PermRead, Home: "moved"}}
+	server, err = New(opts)
+	dieMaybe(t, err)
+	defer server.Close()
+	ts = httptest.NewServer(server)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL+"/fulltext?q=brown+fox", nil)
+	dieMaybe(t, err)
+	status, body := doWithAuth(t, req, "bob")
+	dieMaybe(t, json.Unmarshal([]byte(body), &result))
+	if status != 200 || result.Total != 1 || result.Results[0].Path != "/film.srt" || result.Results[0].Href != "/film.srt" {
+		t.Fatal("results not relative to home", status, result)
+	}
+	if result.Results[0].Snippet == "" {
+		t.Fatal("no snippet in home", result)
+	}
+
+	// snippets are read from the result, not from its path with the prefix stripped once more
+	prefixed := t.TempDir()
+	dieMaybe(t, os.MkdirAll(filepath.Join(prefixed, "files"), 0755))
+	dieMaybe(t, os.WriteFile(filepath.Join(prefixed, "files", "report.txt"), []byte("the quarterly report"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(prefixed, "report.txt"), []byte("something else"), 0644))
+	server, err = New(Options{Root: prefixed, Prefix: "/files/", IndexDir: filepath.Join(t.TempDir(), "index"), IndexInterval: -1})
+	dieMaybe(t, err)
+	defer server.Close()
+	dieMaybe(t, server.RebuildIndex())
+	prefixedServer := httptest.NewServer(server)
+	defer prefixedServer.Close()
+	result = fullText(t, prefixedServer.URL+"/files/fulltext?q=quarterly")
+	if result.Total != 1 || result.Results[0].Path != "/files/report.txt" || result.Results[0].Snippet != "the quarterly report" {
+		t.Fatal("wrong result with a prefix", result)
+	}
+
+	if _, err := New(Options{Root: scratch, IndexDir: filepath.Join(scratch, "index")}); err == nil {
+		t.Fatal("index inside the share accepted")
+	}
+}
@@ -0,0 +1,118 @@
+package gosses
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"io/ioutil"
+)
+
+// Default of Options.MaxRPCSize, as RPC calls are tiny JSON documents.
+const defaultMaxRPCSize = 1 << 20
+
+// Allowance for the multipart framing around an uploaded file,
+// so requests can be rejected from their Content-Length before reading any of it.
+const multipartOverhead = 64 << 10
+
+// How many bytes of an upload of unknown size are written between checks of the free space.
+const freeSpaceCheckInterval = 1 << 20
+
+// Rejects an upload of size bytes into a shared dir if it crosses the upload size or free space limits.
+// A negative size means it isn't known yet, in which case only the free space is checked.
+func (s *Server) checkUploadLimits(dir string, size int64) error {
+	return s.checkLimits(s.storage, dir, size)
+}
+
+// Like checkUploadLimits, for the staging directory on the local filesystem.
+func (s *Server) checkStagingLimits(size int64) error {
+	return s.checkLimits(LocalStorage{}, s.opts.StagingDir, size)
+}
+
+func (s *Server) checkLimits(storage Storage, dir string, size int64) error {
+	if s.opts.MaxUploadSize > 0 && size > s.opts.MaxUploadSize {
+		return s.errUploadTooLarge()
+	}
+	if size < 0 {
+		size = 0
+	}
+	return s.checkFreeSpace(storage, dir, size)
+}
+
+// Rejects writing size more bytes into dir if that would leave less than the minimum free space.
+func (s *Server) checkFreeSpace(storage Storage, dir string, size int64) error {
+	spacer, ok := storage.(FreeSpacer)
+	if s.opts.MinFreeSpace <= 0 || !ok {
+		return nil
+	}
+	free, err := spacer.FreeSpace(dir)
+	if err != nil {
+		s.opts.Logger.Warn().Err(err).Str("dir", dir).Msg("skipped free space check")
+		return nil
+	}
+	if free-size < s.opts.MinFreeSpace {
+		return echo.NewHTTPError(507, fmt.Sprintf("not enough free space, %s must remain available",
+			humanize(s.opts.MinFreeSpace)))
+	}
+	return nil
+}
+
+func (s *Server) errUploadTooLarge() error {
+	return echo.NewHTTPError(413, fmt.Sprintf("file exceeds the maximum upload size of %s",
+		humanize(s.opts.MaxUploadSize)))
+}
+
+// Copies an uploaded file from src to dst, failing once it exceeds the maximum upload size.
+func (s *Server) copyUpload(dst io.Writer, src io.Reader) (int64, error) {
+	if s.opts.MaxUploadSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	written, err := io.Copy(dst, io.LimitReader(src, s.opts.MaxUploadSize+1))
+	if err == nil && written > s.opts.MaxUploadSize {
+		err = s.errUploadTooLarge()
+	}
+	return written, err
+}
+
+// Fails writes into a shared dir once they would leave less than the minimum free space,
+// for uploads whose size isn't bounded beforehand.
+type freeSpaceWriter struct {
+	s         *Server
+	writer    io.Writer
+	dir       string
+	unchecked int64
+}
+
+func (w *freeSpaceWriter) Write(p []byte) (int, error) {
+	if w.unchecked += int64(len(p)); w.unchecked >= freeSpaceCheckInterval {
+		w.unchecked = 0
+		if err := w.s.checkFreeSpace(w.s.storage, w.dir, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	return w.writer.Write(p)
+}
+
+// Counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// Reads a request body of at most the maximum RPC size.
+func (s *Server) readRPCBody(body io.Reader) ([]byte, error) {
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(body, s.opts.MaxRPCSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(bodyBytes)) > s.opts.MaxRPCSize {
+		return nil, echo.NewHTTPError(413, fmt.Sprintf("request exceeds the maximum size of %s",
+			humanize(s.opts.MaxRPCSize)))
+	}
+	return bodyBytes, nil
+}
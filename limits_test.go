@@ -0,0 +1,109 @@
+package gosses
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	scratch := t.TempDir()
+	opts := Options{Root: scratch, StagingDir: t.TempDir(), MaxUploadSize: 10, MaxRPCSize: 64}
+	fmt.Println("========== testing upload limits ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		if postDummyFile(t, url, "%2Fsmall.txt", "small") != `ok` {
+			t.Fatal("upload within limit failed")
+		}
+		if body := postDummyFile(t, url, "%2Flarge.txt", strings.Repeat("x", 11)); !strings.Contains(body, "maximum upload size") {
+			t.Fatal("upload over limit passed", body)
+		}
+		if _, err := os.Stat(filepath.Join(scratch, "large.txt")); err == nil {
+			t.Fatal("partial upload kept")
+		}
+
+		if postJSON(t, url+"rpc", `{"call":"mkdirp","args":["/a"]}`) != `ok` {
+			t.Fatal("rpc within limit failed")
+		}
+		if postJSON(t, url+"rpc", `{"call":"mkdirp","args":["/`+strings.Repeat("a", 64)+`"]}`) == `ok` {
+			t.Fatal("rpc over limit passed")
+		}
+
+		resp := tusRequest(t, "OPTIONS", url+"tus/", nil, nil)
+		if resp.Header.Get("Tus-Max-Size") != "10" {
+			t.Fatal("maximum size not advertised")
+		}
+		resp = tusRequest(t, "POST", url+"tus/", nil, map[string]string{
+			"Upload-Length":   "11",
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte("/large.txt")),
+		})
+		if resp.StatusCode != 413 {
+			t.Fatal("resumable upload over limit accepted", resp.StatusCode)
+		}
+	})
+}
+
+func TestLimitsFreeSpace(t *testing.T) {
+	if _, err := diskFree(os.TempDir()); err != nil {
+		t.Skip(err)
+	}
+	opts := Options{Root: t.TempDir(), StagingDir: t.TempDir(), MinFreeSpace: 1 << 62}
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		if body := postDummyFile(t, url, "%2Fa.txt", "a"); !strings.Contains(body, "not enough free space") {
+			t.Fatal("upload on full disk passed", body)
+		}
+		resp := tusRequest(t, "POST", url+"tus/", nil, map[string]string{
+			"Upload-Length":   "1",
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte("/a.txt")),
+		})
+		if resp.StatusCode != 507 {
+			t.Fatal("resumable upload on full disk accepted", resp.StatusCode)
+		}
+	})
+
+	fmt.Println("========== testing free space of multi-file uploads ============")
+	scratch := t.TempDir()
+	free, err := diskFree(scratch)
+	dieMaybe(t, err)
+	payload := strings.Repeat("x", 16<<20)
+	autoServe(t, Options{Root: scratch, MinFreeSpace: free - 4<<20}, func(url string) {
+		results := postFiles(t, url+"/post", "%2F", [][2]string{{"a.txt", payload}})
+		if len(results) != 1 || results[0].Ok || !strings.Contains(results[0].Error, "not enough free space") {
+			t.Fatal("upload over the free space passed", results)
+		}
+		// without a length, the upload fails while being written
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		fileWriter, err := w.CreateFormFile("file", "b.txt")
+		dieMaybe(t, err)
+		_, err = fileWriter.Write([]byte(payload))
+		dieMaybe(t, err)
+		dieMaybe(t, w.Close())
+		req, err := http.NewRequest("POST", url+"/post", ioutil.NopCloser(&b))
+		dieMaybe(t, err)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Set("Gossa-Dir", "%2F")
+		resp, err := http.DefaultClient.Do(req)
+		dieMaybe(t, err)
+		defer resp.Body.Close()
+		var chunkedResults []uploadResult
+		dieMaybe(t, json.NewDecoder(resp.Body).Decode(&chunkedResults))
+		if len(chunkedResults) != 1 || chunkedResults[0].Ok || !strings.Contains(chunkedResults[0].Error, "not enough free space") {
+			t.Fatal("upload of unknown size over the free space passed", chunkedResults)
+		}
+		for _, name := range []string{"a.txt", "b.txt"} {
+			if _, err := os.Stat(filepath.Join(scratch, name)); !os.IsNotExist(err) {
+				t.Fatal("upload over the free space kept", name)
+			}
+		}
+	})
+}
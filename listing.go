@@ -0,0 +1,389 @@
+package gosses
+
+import (
+	"github.com/labstack/echo/v4"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A directory listing for API clients.
+type dirListing struct {
+	// Path of the directory, relative to the root of the current user.
+	Path string `json:"path"`
+	// Number of entries matching the filters, across all pages.
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Entries []listEntry `json:"entries"`
+}
+
+// A file or directory in a listing.
+type listEntry struct {
+	Name string `json:"name"`
+	// Either 'dir' or 'file'. Symlinks count as files unless they are followed.
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Permissions in the format of ls, e.g. '-rw-r--r--'.
+	Mode    string `json:"mode"`
+	Symlink bool   `json:"symlink"`
+	// Url of the entry, including the prefix.
+	Href string `json:"href"`
+}
+
+// Reports whether the client asked for JSON through the format parameter or the Accept header.
+func wantsJSON(c echo.Context) bool {
+	if c.QueryParam("format") == "json" {
+		return true
+	}
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	return strings.Contains(accept, echo.MIMEApplicationJSON) && !strings.Contains(accept, "text/html")
+}
+
+// How to sort, filter and paginate a listing, taken from the query parameters of a request.
+type listQuery struct {
+	// One of 'name', 'size', 'mtime' or 'type'.
+	Sort string
+	Desc bool
+	// Only entries whose name contains Filter, ignoring case, are listed.
+	Filter string
+	// Only files with one of these extensions are listed. Directories are kept so they can still be opened.
+	Exts map[string]bool
+	// Number of entries to skip, and to list after that. A Limit of 0 lists all of them.
+	Offset int
+	Limit  int
+}
+
+// An entry of a directory that might be listed, stat only once needed.
+type dirCandidate struct {
+	name    string
+	path    string
+	dir     bool
+	symlink bool
+	stat    fs.FileInfo
+}
+
+// Parses the sort, order, filter, ext, offset and limit query parameters.
+func (s *Server) parseListQuery(c echo.Context) (listQuery, error) {
+	query := listQuery{Sort: "name", Filter: strings.ToLower(c.QueryParam("filter")), Limit: s.opts.PageSize}
+	if sortKey := c.QueryParam("sort"); sortKey != "" {
+		if sortKey != "name" && sortKey != "size" && sortKey != "mtime" && sortKey != "type" {
+			return query, echo.NewHTTPError(400, "sort must be name, size, mtime or type")
+		}
+		query.Sort = sortKey
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return query, echo.NewHTTPError(400, "order must be asc or desc")
+	}
+	for _, ext := range strings.Split(c.QueryParam("ext"), ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			if query.Exts == nil {
+				query.Exts = map[string]bool{}
+			}
+			query.Exts[ext] = true
+		}
+	}
+	for name, value := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		if param := c.QueryParam(name); param != "" {
+			number, err := strconv.Atoi(param)
+			if err != nil || number < 0 {
+				return query, echo.NewHTTPError(400, name+" must be a positive number")
+			}
+			*value = number
+		}
+	}
+	return query, nil
+}
+
+// Reads the entries of a directory that are shown in listings and match query, sorted and paginated by it.
+// Also returns the number of matching entries across all pages.
+// An empty dirPath reads the mounts at the virtual root.
+// Only the listed entries are stat, unless sorting needs more.
+func (s *Server) readDir(dirPath string, query listQuery) ([]listEntry, int, error) {
+	candidates, err := s.readDirCandidates(dirPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	matching := candidates[:0]
+	for _, candidate := range candidates {
+		if query.Filter != "" && !strings.Contains(strings.ToLower(candidate.name), query.Filter) {
+			continue
+		}
+		if query.Exts != nil && !candidate.dir && !query.Exts[extOf(candidate.name)] {
+			continue
+		}
+		matching = append(matching, candidate)
+	}
+	if query.Sort == "size" || query.Sort == "mtime" {
+		for i := range matching {
+			if err := s.statCandidate(&matching[i]); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		if query.Desc {
+			i, j = j, i
+		}
+		return lessCandidate(&matching[i], &matching[j], query.Sort)
+	})
+	total := len(matching)
+	if query.Offset < total {
+		matching = matching[query.Offset:]
+	} else {
+		matching = nil
+	}
+	if query.Limit > 0 && query.Limit < len(matching) {
+		matching = matching[:query.Limit]
+	}
+	entries := []listEntry{}
+	for i := range matching {
+		if err := s.statCandidate(&matching[i]); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, newListEntry(matching[i].name, matching[i].stat, matching[i].symlink))
+	}
+	return entries, total, nil
+}
+
+// Reads the names of the entries of a directory that are shown in listings.
+func (s *Server) readDirCandidates(dirPath string) ([]dirCandidate, error) {
+	var candidates []dirCandidate
+	if dirPath == "" {
+		for _, mount := range s.mounts {
+			if s.opts.SkipHidden && strings.HasPrefix(mount.Name, ".") {
+				continue
+			}
+			// mounts are followed even without Options.Symlinks
+			stat, err := s.storage.Stat(mount.Path)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, dirCandidate{name: mount.Name, path: mount.Path, dir: true, stat: stat})
+		}
+		return candidates, nil
+	}
+	files, err := s.storage.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempFilePrefix) {
+			continue
+		}
+		if s.opts.Precompressed && s.opts.HidePrecompressed && s.isPrecompressed(dirPath, file.Name(), names) {
+			continue
+		}
+		if s.opts.SkipHidden && strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		candidate := dirCandidate{
+			name:    file.Name(),
+			path:    filepath.Join(dirPath, file.Name()),
+			dir:     file.IsDir(),
+			symlink: file.Type()&fs.ModeSymlink != 0,
+		}
+		// whether a followed symlink is a directory is only known from its target
+		if candidate.symlink && s.opts.Symlinks {
+			if err := s.statCandidate(&candidate); err != nil {
+				return nil, err
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// Lists a directory for the WebDAV and SFTP servers, with the entries shown in listings under the names they
+// are shown with. An empty dirPath lists the mounts at the virtual root.
+func (s *Server) listShared(dirPath string) ([]fs.FileInfo, error) {
+	candidates, err := s.readDirCandidates(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fs.FileInfo
+	for i := range candidates {
+		if err := s.statCandidate(&candidates[i]); err != nil {
+			return nil, err
+		}
+		entries = append(entries, renamedFileInfo{candidates[i].stat, candidates[i].name})
+	}
+	return entries, nil
+}
+
+// Stats a file resolved by resolveSharePath, naming the directory of a mount after the mount.
+func (s *Server) statShared(filePath string, mount *Mount) (fs.FileInfo, error) {
+	if filePath == "" {
+		return virtualRootInfo{}, nil
+	}
+	info, err := s.stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if s.root == nil && filePath == mount.Path {
+		return renamedFileInfo{info, mount.Name}, nil
+	}
+	return info, nil
+}
+
+// A file shown under another name, like the directory of a mount.
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (info renamedFileInfo) Name() string {
+	return info.name
+}
+
+// The virtual root listing all mounts.
+type virtualRootInfo struct{}
+
+func (virtualRootInfo) Name() string       { return "/" }
+func (virtualRootInfo) Size() int64        { return 0 }
+func (virtualRootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (virtualRootInfo) ModTime() time.Time { return time.Time{} }
+func (virtualRootInfo) IsDir() bool        { return true }
+func (virtualRootInfo) Sys() interface{}   { return nil }
+
+func (s *Server) statCandidate(candidate *dirCandidate) error {
+	if candidate.stat != nil {
+		return nil
+	}
+	stat, err := s.stat(candidate.path)
+	if err != nil {
+		return err
+	}
+	candidate.stat = stat
+	candidate.dir = stat.IsDir()
+	return nil
+}
+
+// Returns the size of a file as listed, which is 0 for directories.
+func (candidate *dirCandidate) size() int64 {
+	if candidate.dir {
+		return 0
+	}
+	return candidate.stat.Size()
+}
+
+// Orders entries by the given sort key, falling back to their names.
+// Sorting by type puts directories first, and files by extension.
+func lessCandidate(a *dirCandidate, b *dirCandidate, sortKey string) bool {
+	switch sortKey {
+	case "size":
+		if sizeA, sizeB := a.size(), b.size(); sizeA != sizeB {
+			return sizeA < sizeB
+		}
+	case "mtime":
+		if !a.stat.ModTime().Equal(b.stat.ModTime()) {
+			return a.stat.ModTime().Before(b.stat.ModTime())
+		}
+	case "type":
+		if a.dir != b.dir {
+			return a.dir
+		}
+		if extA, extB := extOf(a.name), extOf(b.name); extA != extB {
+			return extA < extB
+		}
+	}
+	return naturalLess(a.name, b.name)
+}
+
+// Returns the extension of a file name in lower case and without the dot.
+func extOf(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// Compares names in natural order, ignoring case, so that 'file2' comes before 'file10'.
+func naturalLess(a string, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numberA, numberB := leadingDigits(a), leadingDigits(b)
+			a, b = a[len(numberA):], b[len(numberB):]
+			trimmedA, trimmedB := strings.TrimLeft(numberA, "0"), strings.TrimLeft(numberB, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return len(trimmedA) < len(trimmedB)
+			}
+			if trimmedA != trimmedB {
+				return trimmedA < trimmedB
+			}
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func leadingDigits(str string) string {
+	end := 0
+	for end < len(str) && isDigit(str[end]) {
+		end++
+	}
+	return str[:end]
+}
+
+func newListEntry(name string, stat fs.FileInfo, symlink bool) listEntry {
+	entry := listEntry{
+		Name:    name,
+		Type:    "file",
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Mode:    stat.Mode().String(),
+		Symlink: symlink,
+	}
+	if stat.IsDir() {
+		entry.Type = "dir"
+		entry.Size = 0
+	}
+	return entry
+}
+
+// Fills in the urls of entries listed in the directory at rel.
+func (s *Server) newDirListing(rel string, entries []listEntry, total int, query listQuery) dirListing {
+	dirPath := strings.TrimSuffix(rel, "/") + "/"
+	listing := dirListing{Path: dirPath, Total: total, Offset: query.Offset, Limit: query.Limit, Entries: []listEntry{}}
+	for _, entry := range entries {
+		href := s.opts.Prefix + strings.TrimPrefix(dirPath, "/") + entry.Name
+		if entry.Type == "dir" {
+			href += "/"
+		}
+		entry.Href = (&url.URL{Path: href}).EscapedPath()
+		listing.Entries = append(listing.Entries, entry)
+	}
+	return listing
+}
+
+// Returns the query string of the request with offset replaced, linking to another page of a listing.
+func pageQuery(c echo.Context, offset int) string {
+	params := url.Values{}
+	for key, values := range c.QueryParams() {
+		params[key] = values
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	params.Set("offset", strconv.Itoa(offset))
+	return "?" + params.Encode()
+}
@@ -0,0 +1,124 @@
+package gosses
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getListing(t *testing.T, url string, accept string) dirListing {
+	req, err := http.NewRequest("GET", url, nil)
+	dieMaybe(t, err)
+	req.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	var listing dirListing
+	dieMaybe(t, json.NewDecoder(resp.Body).Decode(&listing))
+	return listing
+}
+
+func TestJSONListing(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.Mkdir(filepath.Join(scratch, "sub"), 0755))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "a b.txt"), []byte("hello"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, ".hidden"), nil, 0644))
+	if err := os.Symlink("a b.txt", filepath.Join(scratch, "link")); err != nil {
+		t.Skip(err)
+	}
+	fmt.Println("========== testing json listings ============")
+	autoServe(t, Options{Root: scratch, Prefix: "/files/", SkipHidden: true}, func(url string) {
+		url += "/files/"
+		listing := getListing(t, url+"?format=json", "")
+		if listing.Path != "/" || len(listing.Entries) != 3 {
+			t.Fatal("wrong listing", listing)
+		}
+		file, link, sub := listing.Entries[0], listing.Entries[1], listing.Entries[2]
+		if file.Name != "a b.txt" || file.Type != "file" || file.Size != 5 || !strings.HasPrefix(file.Mode, "-rw") ||
+			file.Symlink || file.Href != "/files/a%20b.txt" || file.ModTime.IsZero() {
+			t.Fatal("wrong file entry", file)
+		}
+		if !link.Symlink || !strings.HasPrefix(link.Mode, "L") {
+			t.Fatal("wrong symlink entry", link)
+		}
+		if sub.Type != "dir" || sub.Href != "/files/sub/" {
+			t.Fatal("wrong directory entry", sub)
+		}
+		if listing = getListing(t, url+"sub/", "application/json"); listing.Path != "/sub/" || len(listing.Entries) != 0 {
+			t.Fatal("wrong listing of subdirectory", listing)
+		}
+		if body := get(t, url); !strings.Contains(body, `href="sub">sub/</a>`) {
+			t.Fatal("html listing broken")
+		}
+	})
+	autoServe(t, Options{Root: scratch, Symlinks: true}, func(url string) {
+		listing := getListing(t, url+"/", "application/json")
+		if link := listing.Entries[2]; link.Name != "link" || !link.Symlink || link.Size != 5 || !strings.HasPrefix(link.Mode, "-rw") {
+			t.Fatal("followed symlink entry wrong", link)
+		}
+	})
+}
+
+func TestListingQuery(t *testing.T) {
+	scratch := t.TempDir()
+	for i, name := range []string{"file10.txt", "file2.txt", "File1.jpg", "notes.md"} {
+		dieMaybe(t, os.WriteFile(filepath.Join(scratch, name), []byte(strings.Repeat("x", 10-i)), 0644))
+	}
+	dieMaybe(t, os.Mkdir(filepath.Join(scratch, "folder"), 0755))
+	names := func(listing dirListing) string {
+		var result []string
+		for _, entry := range listing.Entries {
+			result = append(result, entry.Name)
+		}
+		return strings.Join(result, " ")
+	}
+	fmt.Println("========== testing listing queries ============")
+	autoServe(t, Options{Root: scratch, PageSize: 2}, func(url string) {
+		url += "/?format=json&"
+		if listing := getListing(t, url+"limit=0", ""); names(listing) != "File1.jpg file2.txt file10.txt folder notes.md" {
+			t.Fatal("wrong natural order", names(listing))
+		}
+		listing := getListing(t, url+"offset=2", "")
+		if names(listing) != "file10.txt folder" || listing.Total != 5 || listing.Limit != 2 {
+			t.Fatal("wrong page", names(listing), listing.Total)
+		}
+		if listing = getListing(t, url+"sort=size&order=desc&limit=3", ""); names(listing) != "file10.txt file2.txt File1.jpg" {
+			t.Fatal("wrong size order", names(listing))
+		}
+		if listing = getListing(t, url+"sort=type&limit=0", ""); names(listing) != "folder File1.jpg notes.md file2.txt file10.txt" {
+			t.Fatal("wrong type order", names(listing))
+		}
+		if listing = getListing(t, url+"filter=FILE&ext=txt,.md", ""); names(listing) != "file2.txt file10.txt" || listing.Total != 2 {
+			t.Fatal("wrong filter", names(listing))
+		}
+		if listing = getListing(t, url+"ext=md", ""); names(listing) != "folder notes.md" {
+			t.Fatal("directories filtered by extension", names(listing))
+		}
+		if resp, err := http.Get(url + "sort=colour"); err != nil || resp.StatusCode != 400 {
+			t.Fatal("invalid sort accepted")
+		}
+
+		url = strings.TrimSuffix(url, "?format=json&")
+		body := get(t, url)
+		if !strings.Contains(body, `href="File1.jpg"`) || strings.Contains(body, `href="file10.txt"`) {
+			t.Fatal("html listing not paginated")
+		}
+		if !strings.Contains(body, `1-2 of 5 <a href="?offset=2">next</a>`) || strings.Contains(body, "previous") {
+			t.Fatal("wrong first page navigation", body)
+		}
+		body = get(t, url+"?offset=2")
+		if !strings.Contains(body, `href="file10.txt"`) || !strings.Contains(body, `href="folder"`) ||
+			!strings.Contains(body, `<a href="?offset=0">previous</a> 3-4 of 5 <a href="?offset=4">next</a>`) {
+			t.Fatal("wrong middle page navigation", body)
+		}
+		body = get(t, url+"?offset=4&sort=name")
+		if !strings.Contains(body, `href="notes.md"`) || strings.Contains(body, `href="file10.txt"`) ||
+			!strings.Contains(body, `<a href="?offset=2&amp;sort=name">previous</a> 5-5 of 5</p>`) {
+			t.Fatal("wrong last page navigation", body)
+		}
+	})
+}
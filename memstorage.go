@@ -0,0 +1,451 @@
+package gosses
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errDirNotEmpty = errors.New("directory not empty")
+
+// MemStorage is a Storage keeping files in memory, for tests and ephemeral shares. It has no symlinks.
+// The directories to share must be created with MkdirAll before passing it to New.
+type MemStorage struct {
+	mu   sync.RWMutex
+	root *memNode
+	// Incremented to name temporary files.
+	temps int
+}
+
+// A file or directory of a MemStorage.
+type memNode struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+	// The entries of a directory by name, nil for files.
+	children map[string]*memNode
+}
+
+func (n *memNode) info() fs.FileInfo {
+	return &memInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	root := &memNode{name: string(filepath.Separator), mode: fs.ModeDir | 0755, modTime: time.Now(),
+		children: map[string]*memNode{}}
+	return &MemStorage{root: root}
+}
+
+// Splits a path into its elements, of which the root has none.
+func memSplit(name string) []string {
+	name = filepath.Clean(name)
+	name = name[len(filepath.VolumeName(name)):]
+	var parts []string
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Returns the node at name. The caller must hold mu.
+func (m *MemStorage) lookup(op string, name string) (*memNode, error) {
+	node := m.root
+	for _, part := range memSplit(name) {
+		if node.children == nil || node.children[part] == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		node = node.children[part]
+	}
+	return node, nil
+}
+
+// Returns the directory containing name and the base name of name in it. The caller must hold mu.
+func (m *MemStorage) lookupParent(op string, name string) (*memNode, string, error) {
+	parts := memSplit(name)
+	if len(parts) == 0 {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	parent, err := m.lookup(op, filepath.Dir(filepath.Clean(name)))
+	if err != nil {
+		return nil, "", err
+	}
+	if parent.children == nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+func (m *MemStorage) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (m *MemStorage) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemStorage) EvalSymlinks(name string) (string, error) {
+	if _, err := m.Stat(name); err != nil {
+		return "", err
+	}
+	return filepath.Clean(name), nil
+}
+
+func (m *MemStorage) Readlink(name string) (string, error) {
+	if _, err := m.Stat(name); err != nil {
+		return "", err
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (m *MemStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	entries := make([]fs.DirEntry, 0, len(node.children))
+	for _, child := range node.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info()))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemStorage) Walk(root string, followSymlinks bool, walkFn filepath.WalkFunc) error {
+	info, err := m.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = m.walk(root, info, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// Walks the tree at path like filepath.Walk, without holding mu so walkFn may change it.
+func (m *MemStorage) walk(path string, info fs.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+	entries, err := m.ReadDir(path)
+	if err := walkFn(path, info, err); err != nil || entries == nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryInfo, _ := entry.Info()
+		if err := m.walk(filepath.Join(path, entry.Name()), entryInfo, walkFn); err != nil {
+			if !entryInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemStorage) Open(name string) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{m: m, node: node, name: name}, nil
+}
+
+func (m *MemStorage) CreateTemp(dir string, pattern string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, err := m.lookup("createtemp", dir)
+	if err != nil {
+		return nil, err
+	}
+	if parent.children == nil {
+		return nil, &fs.PathError{Op: "createtemp", Path: dir, Err: errNotDir}
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for {
+		m.temps++
+		name := prefix + strconv.Itoa(m.temps) + suffix
+		if parent.children[name] == nil {
+			node := &memNode{name: name, mode: 0600, modTime: time.Now()}
+			parent.children[name] = node
+			parent.modTime = node.modTime
+			return &memFile{m: m, node: node, name: filepath.Join(dir, name), writable: true}, nil
+		}
+	}
+}
+
+func (m *MemStorage) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, base, err := m.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if parent.children[base] != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	node := &memNode{name: base, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: map[string]*memNode{}}
+	parent.children[base] = node
+	parent.modTime = node.modTime
+	return nil
+}
+
+func (m *MemStorage) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node := m.root
+	for _, part := range memSplit(name) {
+		child := node.children[part]
+		if child == nil {
+			child = &memNode{name: part, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(),
+				children: map[string]*memNode{}}
+			node.children[part] = child
+			node.modTime = child.modTime
+		} else if child.children == nil {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		node = child
+	}
+	return nil
+}
+
+func (m *MemStorage) Rename(oldName string, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldParent, oldBase, err := m.lookupParent("rename", oldName)
+	if err != nil {
+		return err
+	}
+	node := oldParent.children[oldBase]
+	if node == nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	newParent, newBase, err := m.lookupParent("rename", newName)
+	if err != nil {
+		return err
+	}
+	existing := newParent.children[newBase]
+	if existing == node {
+		return nil
+	}
+	if node.children != nil {
+		// a directory can't be moved inside itself
+		rel, err := filepath.Rel(filepath.Clean(oldName), filepath.Clean(newName))
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrInvalid}
+		}
+	}
+	if existing != nil {
+		if existing.children != nil && node.children == nil {
+			return &fs.PathError{Op: "rename", Path: newName, Err: errIsDir}
+		} else if existing.children == nil && node.children != nil {
+			return &fs.PathError{Op: "rename", Path: newName, Err: errNotDir}
+		} else if len(existing.children) > 0 {
+			return &fs.PathError{Op: "rename", Path: newName, Err: errDirNotEmpty}
+		}
+	}
+	now := time.Now()
+	delete(oldParent.children, oldBase)
+	oldParent.modTime = now
+	node.name = newBase
+	newParent.children[newBase] = node
+	newParent.modTime = now
+	return nil
+}
+
+func (m *MemStorage) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, base, err := m.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+	node := parent.children[base]
+	if node == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(node.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+	}
+	delete(parent.children, base)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (m *MemStorage) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parent, base, err := m.lookupParent("removeall", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if parent.children[base] != nil {
+		delete(parent.children, base)
+		parent.modTime = time.Now()
+	}
+	return nil
+}
+
+func (m *MemStorage) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// A file opened from a MemStorage. Only temporary files are writable, as that's how shared files are written.
+type memFile struct {
+	m        *MemStorage
+	node     *memNode
+	name     string
+	offset   int64
+	writable bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.m.mu.RLock()
+	defer f.m.mu.RUnlock()
+	if f.node.children != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.m.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.m.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.m.mu.RLock()
+	defer f.m.mu.RUnlock()
+	return f.node.info(), nil
+}
+
+func (f *memFile) Chmod(mode fs.FileMode) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	f.node.mode = f.node.mode&^fs.ModePerm | mode.Perm()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
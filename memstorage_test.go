@@ -0,0 +1,124 @@
+package gosses
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func memWriteFile(t *testing.T, storage Storage, path string, data []byte) {
+	dieMaybe(t, writeAtomic(storage, path, func(file File) error {
+		_, err := file.Write(data)
+		return err
+	}, nil))
+}
+
+// Copies a local directory into storage at the same path.
+func memCopyDir(t *testing.T, storage Storage, dir string) string {
+	dir, err := filepath.Abs(dir)
+	dieMaybe(t, err)
+	dieMaybe(t, filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return storage.MkdirAll(path, info.Mode().Perm())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		memWriteFile(t, storage, path, data)
+		return storage.Chtimes(path, info.ModTime(), info.ModTime())
+	}))
+	return dir
+}
+
+func TestMemStorage(t *testing.T) {
+	storage := NewMemStorage()
+	fmt.Println("========== testing memory storage ============")
+	dieMaybe(t, storage.MkdirAll("/share/a/b", 0755))
+	memWriteFile(t, storage, "/share/a/c.txt", []byte("hello"))
+	memWriteFile(t, storage, "/share/d.txt", []byte("world"))
+	if err := storage.MkdirAll("/share/d.txt/e", 0755); err == nil {
+		t.Fatal("directory created in a file")
+	}
+	if err := storage.Mkdir("/share/x/y", 0755); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("directory created without its parent", err)
+	}
+	entries, err := storage.ReadDir("/share/a")
+	dieMaybe(t, err)
+	if len(entries) != 2 || entries[0].Name() != "b" || !entries[0].IsDir() || entries[1].Name() != "c.txt" {
+		t.Fatal("wrong entries", entries)
+	}
+	info, err := storage.Stat("/share/a/c.txt")
+	dieMaybe(t, err)
+	if info.Size() != 5 || info.Mode().Perm() != 0644 {
+		t.Fatal("wrong info", info.Size(), info.Mode())
+	}
+
+	file, err := storage.Open("/share/a/c.txt")
+	dieMaybe(t, err)
+	buf := make([]byte, 3)
+	if n, err := file.ReadAt(buf, 2); n != 3 || err != nil || string(buf) != "llo" {
+		t.Fatal("wrong read", n, err, string(buf))
+	}
+	if _, err := file.Write([]byte("x")); err == nil {
+		t.Fatal("wrote to a file opened for reading")
+	}
+	content, err := ioutil.ReadAll(file)
+	dieMaybe(t, err)
+	dieMaybe(t, file.Close())
+	if string(content) != "hello" {
+		t.Fatal("wrong content", string(content))
+	}
+
+	var walked []string
+	dieMaybe(t, storage.Walk("/share", false, func(path string, info fs.FileInfo, err error) error {
+		walked = append(walked, path)
+		if info.Name() == "b" {
+			return filepath.SkipDir
+		}
+		return err
+	}))
+	if fmt.Sprint(walked) != fmt.Sprint([]string{"/share", "/share/a", "/share/a/b", "/share/a/c.txt", "/share/d.txt"}) {
+		t.Fatal("wrong walk", walked)
+	}
+
+	if err := storage.Rename("/share/a", "/share/a/b/a"); err == nil {
+		t.Fatal("directory moved inside itself")
+	}
+	if err := storage.Rename("/share/d.txt", "/share/a"); err == nil {
+		t.Fatal("file replaced a directory")
+	}
+	dieMaybe(t, storage.Rename("/share/d.txt", "/share/a/c.txt"))
+	file, err = storage.Open("/share/a/c.txt")
+	dieMaybe(t, err)
+	content, err = ioutil.ReadAll(file)
+	dieMaybe(t, err)
+	file.Close()
+	if string(content) != "world" {
+		t.Fatal("file not replaced", string(content))
+	}
+	if err := storage.Remove("/share/a"); err == nil {
+		t.Fatal("non-empty directory removed")
+	}
+	dieMaybe(t, storage.RemoveAll("/share/a"))
+	dieMaybe(t, storage.RemoveAll("/share/a"))
+	if _, err := storage.Stat("/share/a/c.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("directory not removed", err)
+	}
+}
+
+func TestMemStorageServer(t *testing.T) {
+	storage := NewMemStorage()
+	root := memCopyDir(t, storage, "test-fixture")
+	fmt.Println("========== testing normal path in memory ============")
+	autoServe(t, Options{Root: root, SkipHidden: true, Storage: storage}, func(url string) {
+		doTestRegular(t, url+"/", false)
+	})
+}
@@ -0,0 +1,80 @@
+package gosses
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadMimeTypes parses Apache .types files, each line a Content-Type followed by its file extensions.
+// Returns a map suitable for Options.MimeTypes, in which later files take precedence.
+func LoadMimeTypes(paths ...string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, path := range paths {
+		if err := loadMimeTypesFile(path, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func loadMimeTypesFile(path string, result map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if _, _, err := mime.ParseMediaType(fields[0]); err != nil || !strings.Contains(fields[0], "/") {
+			return fmt.Errorf("%s:%d: invalid type '%s'", path, lineNum, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			result["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns the Content-Type for the extension of a file, preferring Options.MimeTypes over the built-in types.
+func (s *Server) mimeType(name string) string {
+	ext := filepath.Ext(name)
+	if contentType, ok := s.opts.MimeTypes[strings.ToLower(ext)]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Sets the Content-Type of a file about to be served with http.ServeContent, which keeps a type that is already set
+// but doesn't know about Options.MimeTypes. Unknown extensions are left to it to sniff.
+func (s *Server) setCustomContentType(c echo.Context, name string) {
+	if contentType := s.mimeType(name); contentType != "" {
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+	}
+}
+
+// Returns the Ext of a listed file, which the frontend picks an icon with.
+// Files with a custom type are described by it instead of their extension: by the subtype for application/*
+// types, else by the top-level type, e.g. 'foo' for application/foo and 'video' for video/x-matroska.
+func (s *Server) iconExt(name string) string {
+	ext := filepath.Ext(name)
+	contentType, ok := s.opts.MimeTypes[strings.ToLower(ext)]
+	if !ok {
+		return strings.TrimLeft(ext, ".")
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	parts := strings.SplitN(mediaType, "/", 2)
+	if len(parts) == 2 && parts[0] == "application" {
+		return parts[1]
+	}
+	return parts[0]
+}
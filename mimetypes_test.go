@@ -0,0 +1,48 @@
+package gosses
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMimeTypes(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "feeds.OPML"), []byte("<opml></opml>"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "film.mkv"), nil, 0644))
+	override := filepath.Join(scratch, "override.types")
+	dieMaybe(t, os.WriteFile(override, []byte("video/x-matroska mkv\n"), 0644))
+	mimeTypes, err := LoadMimeTypes(filepath.Join("test-fixture", "custom_mime_type.types"), override)
+	dieMaybe(t, err)
+	if mimeTypes[".opml"] != "application/foo" || mimeTypes[".mkv"] != "video/x-matroska" {
+		t.Fatal("types not loaded", mimeTypes)
+	}
+	opts := Options{Root: scratch, MimeTypes: mimeTypes}
+	fmt.Println("========== testing custom mime types ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		resp, err := http.Get(url + "feeds.OPML")
+		dieMaybe(t, err)
+		resp.Body.Close()
+		if resp.Header.Get("Content-Type") != "application/foo" {
+			t.Fatal("custom type not served", resp.Header.Get("Content-Type"))
+		}
+		body := get(t, url)
+		if !strings.Contains(body, `icon-foo"></i></td><td class="display-name"><a class="list-links" onclick="return onClickLink(event)" href="feeds.OPML"`) ||
+			!strings.Contains(body, `icon-video"></i></td><td class="display-name"><a class="list-links" onclick="return onClickLink(event)" href="film.mkv"`) {
+			t.Fatal("custom type not listed")
+		}
+		if !strings.Contains(body, `icon-types"`) {
+			t.Fatal("extension of other files not listed")
+		}
+	})
+
+	invalid := filepath.Join(scratch, "invalid.types")
+	dieMaybe(t, os.WriteFile(invalid, []byte("opml application/foo\n"), 0644))
+	if _, err := LoadMimeTypes(invalid); err == nil {
+		t.Fatal("invalid types file accepted")
+	}
+}
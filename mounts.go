@@ -0,0 +1,115 @@
+package gosses
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Mount is a directory shared as a named folder at the top level of the listing.
+type Mount struct {
+	// Name of the top-level folder.
+	Name string
+	// Directory to share.
+	Path string
+	// Disable upload, rename, move, etc inside this mount.
+	ReadOnly bool
+}
+
+// Validates a directory to share in storage and makes its path absolute.
+func checkMount(storage Storage, mount Mount) (Mount, error) {
+	var err error
+	// required to ensure the stat filename won't be relative (e.g. '..')
+	mount.Path, err = filepath.Abs(mount.Path)
+	if err != nil {
+		return mount, err
+	}
+	if stat, err := storage.Stat(mount.Path); err != nil {
+		return mount, err
+	} else if !stat.IsDir() {
+		return mount, fmt.Errorf("'%s' is not a directory", mount.Path)
+	}
+	return mount, nil
+}
+
+// Validates the mounts of opts, or turns opts.Root into the single mount backing the whole share.
+func (s *Server) setupMounts(opts Options) error {
+	if opts.Root != "" && len(opts.Mounts) > 0 {
+		return fmt.Errorf("root and mounts are mutually exclusive")
+	}
+	if opts.Root != "" {
+		root, err := checkMount(s.storage, Mount{Path: opts.Root})
+		if err != nil {
+			return err
+		}
+		s.root = &root
+		return nil
+	}
+	if len(opts.Mounts) == 0 {
+		return fmt.Errorf("no directory to share")
+	}
+	names := map[string]bool{}
+	for _, mount := range opts.Mounts {
+		if mount.Name == "" || mount.Name == "." || mount.Name == ".." || strings.ContainsAny(mount.Name, `/\`) {
+			return fmt.Errorf("invalid mount name '%s'", mount.Name)
+		}
+		if names[mount.Name] {
+			return fmt.Errorf("duplicate mount name '%s'", mount.Name)
+		}
+		names[mount.Name] = true
+		mount, err := checkMount(s.storage, mount)
+		if err != nil {
+			return fmt.Errorf("mount '%s': %w", mount.Name, err)
+		}
+		s.mounts = append(s.mounts, mount)
+	}
+	return nil
+}
+
+// Splits a cleaned path, relative to the shared namespace, into its mount and the path inside that mount.
+// Returns a nil mount and an empty path for the virtual root listing all mounts.
+func (s *Server) findMount(virtualPath string) (*Mount, string, error) {
+	if s.root != nil {
+		return s.root, virtualPath, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(virtualPath), "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, "", nil
+	}
+	for i := range s.mounts {
+		if s.mounts[i].Name == parts[0] {
+			if len(parts) == 1 {
+				return &s.mounts[i], "", nil
+			}
+			return &s.mounts[i], parts[1], nil
+		}
+	}
+	return nil, "", &fs.PathError{Op: "resolve", Path: virtualPath, Err: fs.ErrNotExist}
+}
+
+// Reports whether files inside mount may be modified at all, regardless of the user.
+// The virtual root listing all mounts is never writable.
+func (s *Server) writable(mount *Mount) bool {
+	return mount != nil && !mount.ReadOnly && !s.opts.ReadOnly
+}
+
+// Checks that a private directory like the one of the search index is outside of every mount, so it isn't shared.
+// what names the directory in the error.
+func (s *Server) checkOutsideMounts(dir string, what string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	mounts := s.mounts
+	if s.root != nil {
+		mounts = []Mount{*s.root}
+	}
+	for _, mount := range mounts {
+		rel, err := filepath.Rel(mount.Path, absDir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s '%s' must be outside of the shared directory '%s'", what, dir, mount.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package gosses
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMounts(t *testing.T) {
+	scratch := t.TempDir()
+	opts := Options{
+		Mounts: []Mount{
+			{Name: "photos", Path: filepath.Join("test-fixture", "hols"), ReadOnly: true},
+			{Name: "scratch", Path: scratch},
+		},
+		SkipHidden: true,
+	}
+	fmt.Println("========== testing mounts ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		body0 := get(t, url)
+		if !strings.Contains(body0, `href="photos">photos/</a>`) || !strings.Contains(body0, `href="scratch">scratch/</a>`) {
+			t.Fatal("mounts not listed")
+		}
+		if !strings.Contains(body0, `window.ro = true`) {
+			t.Fatal("virtual root not read-only")
+		}
+		if body0 = get(t, url+"photos/"); !strings.Contains(body0, `href="glasgow.jpg">glasgow.jpg</a>`) ||
+			!strings.Contains(body0, `<title>/photos/</title>`) {
+			t.Fatal("mount not listed")
+		}
+		if body0 = get(t, url+"photos/c.js"); !strings.Contains(body0, `console.log`) {
+			t.Fatal("file in mount not served")
+		}
+		if get(t, url+"nothing/") != `error` {
+			t.Fatal("unknown mount served")
+		}
+
+		if postDummyFile(t, url, "%2Fphotos%2Fnew.txt", "new") == `ok` {
+			t.Fatal("upload to read-only mount passed")
+		}
+		if postDummyFile(t, url, "%2Fnew.txt", "new") == `ok` {
+			t.Fatal("upload to virtual root passed")
+		}
+		if postDummyFile(t, url, "%2Fscratch%2Fnew.txt", "new") != `ok` || get(t, url+"scratch/new.txt") != `new` {
+			t.Fatal("upload to mount failed")
+		}
+		if _, err := os.Stat(filepath.Join(scratch, "new.txt")); err != nil {
+			t.Fatal("upload not stored in mount")
+		}
+		if postJSON(t, url+"rpc", `{"call":"mv","args":["/scratch/new.txt", "/photos/new.txt"]}`) == `ok` {
+			t.Fatal("mv to read-only mount passed")
+		}
+		if postJSON(t, url+"rpc", `{"call":"mkdirp","args":["/AAA"]}`) == `ok` {
+			t.Fatal("mkdir in virtual root passed")
+		}
+		if postJSON(t, url+"rpc", `{"call":"rm","args":["/scratch"]}`) == `ok` {
+			t.Fatal("rm of mount passed")
+		}
+		if postJSON(t, url+"rpc", `{"call":"rm","args":["/scratch/new.txt"]}`) != `ok` {
+			t.Fatal("rm in mount failed")
+		}
+
+		bodyRaw := getRaw(t, url+"zip?zipPath=%2F&zipName=all")
+		zipReader, err := zip.NewReader(bytes.NewReader(bodyRaw), int64(len(bodyRaw)))
+		dieMaybe(t, err)
+		names := map[string]bool{}
+		for _, file := range zipReader.File {
+			names[file.Name] = true
+		}
+		if !names["photos/glasgow.jpg"] || !names["scratch"] {
+			t.Fatal("zip of virtual root is missing mounts")
+		}
+	})
+}
+
+func TestMountsInvalid(t *testing.T) {
+	for _, mounts := range [][]Mount{
+		{{Name: "a", Path: "test-fixture"}, {Name: "a", Path: "test-fixture"}},
+		{{Name: "a/b", Path: "test-fixture"}},
+		{{Name: "..", Path: "test-fixture"}},
+		{{Name: "a", Path: filepath.Join("test-fixture", "b.txt")}},
+	} {
+		if _, err := New(Options{Mounts: mounts}); err == nil {
+			t.Fatal("invalid mounts accepted", mounts)
+		}
+	}
+	if _, err := New(Options{Root: "test-fixture", Mounts: []Mount{{Name: "a", Path: "test-fixture"}}}); err == nil {
+		t.Fatal("root and mounts accepted together")
+	}
+}
@@ -0,0 +1,147 @@
+package gosses
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Permission is an action a user may perform on the shared files.
+type Permission int
+
+const (
+	PermRead Permission = 1 << iota
+	PermUpload
+	PermMkdir
+	PermMv
+	PermRm
+	PermAll   = PermRead | PermUpload | PermMkdir | PermMv | PermRm
+	permWrite = PermUpload | PermMkdir | PermMv | PermRm
+)
+
+var permissionNames = map[string]Permission{
+	"read":   PermRead,
+	"upload": PermUpload,
+	"mkdir":  PermMkdir,
+	"mv":     PermMv,
+	"rm":     PermRm,
+	"all":    PermAll,
+}
+
+// Profile holds the permissions and home directory of a single user.
+type Profile struct {
+	Perms Permission
+	// Relative to the shared directory, empty for the whole share.
+	Home string
+}
+
+// LoadProfiles loads a profile file with one 'username:permissions[:home]' entry per line, for Options.Profiles.
+// Permissions are comma-separated names from permissionNames, e.g. 'read,upload'.
+func LoadProfiles(path string) (map[string]Profile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := map[string]Profile{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'username:permissions[:home]'", path, lineNum)
+		}
+		profile, err := parseProfile(parts[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		result[parts[0]] = profile
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func parseProfile(fields []string) (Profile, error) {
+	var profile Profile
+	for _, name := range strings.Split(fields[0], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		perm, ok := permissionNames[name]
+		if !ok {
+			return profile, fmt.Errorf("unknown permission '%s'", name)
+		}
+		profile.Perms |= perm
+	}
+	if len(fields) > 1 {
+		profile.Home = fields[1]
+	}
+	return profile, nil
+}
+
+// Confines the home directory of profile to the share and ensures it exists.
+func (s *Server) checkProfile(profile Profile) (Profile, error) {
+	if profile.Home == "" {
+		return profile, nil
+	}
+	// same confinement as resolvePath
+	home := filepath.Clean("/" + profile.Home)[1:]
+	mount, mountPath, err := s.findMount(home)
+	if err != nil {
+		return profile, err
+	}
+	if mount == nil {
+		// the virtual root
+		profile.Home = ""
+		return profile, nil
+	}
+	stat, err := s.storage.Stat(filepath.Join(mount.Path, mountPath))
+	if err != nil {
+		return profile, err
+	}
+	if !stat.IsDir() {
+		return profile, fmt.Errorf("home '%s' is not a directory", profile.Home)
+	}
+	profile.Home = home
+	return profile, nil
+}
+
+// Returns the profile of the user authenticated for this request.
+func (s *Server) currentProfile(c echo.Context) Profile {
+	if username, ok := c.Get("user").(string); ok {
+		if profile, ok := s.opts.Profiles[username]; ok {
+			return profile
+		}
+	}
+	return Profile{Perms: PermAll}
+}
+
+// Reports whether the current user may perform perm.
+// The global read-only mode takes precedence over any profile.
+func (s *Server) hasPermission(c echo.Context, perm Permission) bool {
+	if s.opts.ReadOnly && perm&permWrite != 0 {
+		return false
+	}
+	return s.currentProfile(c).Perms&perm == perm
+}
+
+// Rejects the request unless the current user has perm.
+func (s *Server) permissionChecker(perm Permission) echo.MiddlewareFunc {
+	return func(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !s.hasPermission(c, perm) {
+				return errForbidden
+			}
+			return handlerFunc(c)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package gosses
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func doWithAuth(t *testing.T, req *http.Request, username string) (int, string) {
+	req.SetBasicAuth(username, "secret")
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	dieMaybe(t, err)
+	return resp.StatusCode, trimSpaces(string(body))
+}
+
+func rpcWithAuth(t *testing.T, url string, username string, what string) (int, string) {
+	req, err := http.NewRequest("POST", url+"rpc", bytes.NewBufferString(what))
+	dieMaybe(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	return doWithAuth(t, req, username)
+}
+
+func uploadWithAuth(t *testing.T, url string, username string, path string, payload string) (int, string) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fileWriter, err := w.CreateFormFile("file", "file")
+	dieMaybe(t, err)
+	_, err = fileWriter.Write([]byte(payload))
+	dieMaybe(t, err)
+	dieMaybe(t, w.Close())
+	req, err := http.NewRequest("POST", url+"post", &b)
+	dieMaybe(t, err)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Gossa-Path", path)
+	return doWithAuth(t, req, username)
+}
+
+func TestProfiles(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dieMaybe(t, err)
+	users := map[string][]byte{"alice": hash, "bob": hash, "carol": hash}
+	profilesPath := filepath.Join(t.TempDir(), "perms")
+	dieMaybe(t, os.WriteFile(profilesPath, []byte("bob:read,upload:hols\ncarol:read\n"), 0600))
+	profiles, err := LoadProfiles(profilesPath)
+	dieMaybe(t, err)
+
+	fmt.Println("========== testing user profiles ============")
+	opts := Options{Root: "test-fixture", SkipHidden: true, Users: users, Profiles: profiles}
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		req, _ := http.NewRequest("GET", url, nil)
+		status, body := doWithAuth(t, req, "bob")
+		if status != 200 || !strings.Contains(body, `href="glasgow.jpg">glasgow.jpg</a>`) || !strings.Contains(body, `<title>/</title>`) {
+			t.Fatal("home directory not used as root", status)
+		}
+		req, _ = http.NewRequest("GET", url+"../b.txt", nil)
+		if status, _ = doWithAuth(t, req, "bob"); status != 404 {
+			t.Fatal("escaped home directory", status)
+		}
+		if status, _ = rpcWithAuth(t, url, "bob", `{"call":"mkdirp","args":["/AAA"]}`); status != 403 {
+			t.Fatal("mkdir passed without permission", status)
+		}
+		if status, _ = uploadWithAuth(t, url, "bob", "%2Fbob.txt", "bob"); status != 200 {
+			t.Fatal("upload with permission failed", status)
+		}
+		if _, err := os.Stat(filepath.Join("test-fixture", "hols", "bob.txt")); err != nil {
+			t.Fatal("upload not stored in home directory")
+		}
+		if status, _ = uploadWithAuth(t, url, "bob", "%2Fnew%2Fbob.txt", "bob"); status != 403 {
+			t.Fatal("upload created a directory without permission", status)
+		}
+		if _, err := os.Stat(filepath.Join("test-fixture", "hols", "new")); err == nil {
+			t.Fatal("directory created without permission")
+		}
+		if status, _ = rpcWithAuth(t, url, "bob", `{"call":"rm","args":["/bob.txt"]}`); status != 403 {
+			t.Fatal("rm passed without permission", status)
+		}
+		if status, _ = uploadWithAuth(t, url, "carol", "%2Fcarol.txt", "carol"); status != 403 {
+			t.Fatal("upload passed without permission", status)
+		}
+		req, _ = http.NewRequest("GET", url, nil)
+		if status, body = doWithAuth(t, req, "carol"); !strings.Contains(body, `window.ro = true`) {
+			t.Fatal("read-only user not shown as read-only")
+		}
+		if status, _ = rpcWithAuth(t, url, "alice", `{"call":"rm","args":["/hols/bob.txt"]}`); status != 200 {
+			t.Fatal("cleanup errored", status)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package gosses
+
+import (
+	"bytes"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A compressed copy of a file stored next to it, e.g. 'foo.js.gz' for 'foo.js'.
+type precompressedFormat struct {
+	// Content-Encoding of the copy.
+	encoding string
+	ext      string
+	// Leading bytes of every valid copy, to detect files that merely have the extension.
+	magic []byte
+}
+
+// In order of preference. Brotli has no magic number, so any non-empty file is trusted.
+var precompressedFormats = []precompressedFormat{
+	{"br", ".br", nil},
+	{"zstd", ".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"gzip", ".gz", []byte{0x1f, 0x8b}},
+}
+
+// Serves a precompressed copy of a file if the client accepts one, and reports whether it did.
+func (s *Server) servePrecompressed(c echo.Context, filePath string) (bool, error) {
+	file, stat, encoding := s.openAcceptedPrecompressed(c, s.storage, filePath)
+	if file == nil {
+		return false, nil
+	}
+	defer file.Close()
+	contentType, err := s.contentTypeOf(filePath)
+	if err != nil {
+		return false, err
+	}
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set(echo.HeaderContentEncoding, encoding)
+	http.ServeContent(c.Response(), c.Request(), filepath.Base(filePath), stat.ModTime(), file)
+	return true, nil
+}
+
+// Opens the preferred precompressed copy of a file in storage that the client accepts, and returns it with its encoding.
+// Returns a nil file if there is none.
+func (s *Server) openAcceptedPrecompressed(c echo.Context, storage Storage, filePath string) (File, os.FileInfo, string) {
+	accepted := acceptedEncodings(c.Request().Header.Get(echo.HeaderAcceptEncoding))
+	varied := false
+	for _, format := range precompressedFormats {
+		file, stat := s.openPrecompressed(storage, filePath+format.ext, format)
+		if file == nil {
+			continue
+		}
+		// caches must not serve an encoding to clients that don't accept it
+		if !varied {
+			c.Response().Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			varied = true
+		}
+		if !accepted[format.encoding] {
+			file.Close()
+			continue
+		}
+		return file, stat, format.encoding
+	}
+	return nil, nil, ""
+}
+
+// Opens a precompressed copy in storage, or returns nil if there is none or it isn't actually compressed in format.
+func (s *Server) openPrecompressed(storage Storage, path string, format precompressedFormat) (File, os.FileInfo) {
+	stat, err := s.statIn(storage, path)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() == 0 {
+		return nil, nil
+	}
+	file, err := storage.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	magic := make([]byte, len(format.magic))
+	if _, err := io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, format.magic) {
+		file.Close()
+		return nil, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil
+	}
+	return file, stat
+}
+
+// Reports whether a file in dir is a precompressed copy of another file listed in names.
+func (s *Server) isPrecompressed(dir string, name string, names map[string]bool) bool {
+	for _, format := range precompressedFormats {
+		if strings.HasSuffix(name, format.ext) && names[strings.TrimSuffix(name, format.ext)] {
+			file, _ := s.openPrecompressed(s.storage, filepath.Join(dir, name), format)
+			if file != nil {
+				file.Close()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parses an Accept-Encoding header into the set of encodings it allows.
+func acceptedEncodings(header string) map[string]bool {
+	result := map[string]bool{}
+	for _, item := range strings.Split(header, ",") {
+		params := strings.Split(item, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted := encoding != ""
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				quality, err := strconv.ParseFloat(param[2:], 64)
+				accepted = accepted && err == nil && quality > 0
+			}
+		}
+		if accepted {
+			result[encoding] = true
+		}
+	}
+	return result
+}
+
+// Returns the Content-Type of a file from its extension, or else from its content like http.ServeFile.
+func (s *Server) contentTypeOf(path string) (string, error) {
+	if contentType := s.mimeType(path); contentType != "" {
+		return contentType, nil
+	}
+	file, err := s.storage.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
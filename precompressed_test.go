@@ -0,0 +1,61 @@
+package gosses
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func getEncoded(t *testing.T, url string, acceptEncoding string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	dieMaybe(t, err)
+	// setting the header also stops the client from decompressing the response
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	dieMaybe(t, err)
+	return resp, string(body)
+}
+
+func TestPrecompressed(t *testing.T) {
+	opts := Options{Root: "test-fixture", Precompressed: true, HidePrecompressed: true}
+	fmt.Println("========== testing precompressed files ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		resp, body := getEncoded(t, url+"compress/foo.js", "br;q=0, gzip")
+		if resp.Header.Get("Content-Encoding") != "gzip" || !strings.HasPrefix(body, "\x1f\x8b") {
+			t.Fatal("precompressed file not served", resp.Header)
+		}
+		if !strings.Contains(resp.Header.Get("Content-Type"), "javascript") {
+			t.Fatal("content type of original file lost", resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatal("missing vary header")
+		}
+
+		resp, body = getEncoded(t, url+"compress/foo.js", "identity")
+		if resp.Header.Get("Content-Encoding") != "" || !strings.Contains(body, "exports.foo") {
+			t.Fatal("encoding not honored", resp.Header)
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatal("missing vary header on original file")
+		}
+
+		resp, body = getEncoded(t, url+"gzip/fake_ecstatic", "gzip")
+		if resp.Header.Get("Content-Encoding") != "" || body != "ecstatic" {
+			t.Fatal("fake gzip file served", resp.Header)
+		}
+
+		body = get(t, url+"compress/")
+		if strings.Contains(body, `foo.js.gz`) || !strings.Contains(body, `href="foo.js"`) {
+			t.Fatal("precompressed file listed")
+		}
+		if body = get(t, url+"gzip/"); !strings.Contains(body, `href="fake_ecstatic.gz"`) {
+			t.Fatal("fake gzip file hidden")
+		}
+	})
+}
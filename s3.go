@@ -0,0 +1,1283 @@
+package gosses
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implements the subset of the S3 API that backup and sync tools rely on: listing buckets and objects, getting,
+// putting and deleting objects, and multipart uploads. See https://docs.aws.amazon.com/AmazonS3/latest/API/.
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// The only signing algorithm supported, AWS Signature Version 4.
+const s3Algorithm = "AWS4-HMAC-SHA256"
+
+// Format of X-Amz-Date, the time a request was signed at.
+const s3DateFormat = "20060102T150405Z"
+
+// How far the clock of a client may be off.
+const s3MaxSkew = 15 * time.Minute
+
+// Presigned URLs can be valid for a week at most.
+const s3MaxExpires = 7 * 24 * 60 * 60
+
+const s3MaxParts = 10000
+
+// Payload hash of requests signed without their body, like presigned URLs.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// SHA256 of an empty payload, which the signatures of chunks include.
+const s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Query parameters of ListObjects and ListObjectsV2.
+var s3ListParams = []string{"list-type", "prefix", "delimiter", "max-keys", "continuation-token", "start-after",
+	"marker", "encoding-type", "fetch-owner"}
+
+// Headers GetObject responses can override with query parameters, mostly used by presigned URLs.
+var s3ResponseHeaders = map[string]string{
+	"response-content-type":        echo.HeaderContentType,
+	"response-content-language":    "Content-Language",
+	"response-expires":             "Expires",
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": echo.HeaderContentDisposition,
+	"response-content-encoding":    echo.HeaderContentEncoding,
+}
+
+// S3Key is the secret of an S3 access key and the user it acts as.
+type S3Key struct {
+	Secret string
+	// Username whose profile applies, empty for every permission on the whole share.
+	User string
+}
+
+// LoadS3Keys loads a file with one 'accessKeyId:secret[:username]' entry per line, for Options.S3Keys.
+func LoadS3Keys(path string) (map[string]S3Key, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := map[string]S3Key{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], "/") {
+			return nil, fmt.Errorf("%s:%d: expected 'accessKeyId:secret[:username]'", path, lineNum)
+		}
+		key := S3Key{Secret: parts[1]}
+		if len(parts) == 3 {
+			key.User = parts[2]
+		}
+		result[parts[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, errors.New(path + ": no access keys defined")
+	}
+	return result, nil
+}
+
+// An error answered to S3 clients as an XML document, with one of the codes of S3.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	status  int
+	Code    string
+	Message string
+}
+
+func (err *s3Error) Error() string {
+	return err.Message
+}
+
+func newS3Error(status int, code string, message string) *s3Error {
+	return &s3Error{status: status, Code: code, Message: message}
+}
+
+var (
+	errS3AccessDenied      = newS3Error(403, "AccessDenied", "Access Denied")
+	errS3SignatureMismatch = newS3Error(403, "SignatureDoesNotMatch",
+		"The request signature we calculated does not match the signature you provided")
+	errS3NoSuchBucket    = newS3Error(404, "NoSuchBucket", "The specified bucket does not exist")
+	errS3NoSuchKey       = newS3Error(404, "NoSuchKey", "The specified key does not exist")
+	errS3NoSuchUpload    = newS3Error(404, "NoSuchUpload", "The specified multipart upload does not exist")
+	errS3InvalidKey      = newS3Error(400, "InvalidArgument", "The key is not a valid path")
+	errS3KeyIsFolder     = newS3Error(400, "InvalidRequest", "The key is a folder")
+	errS3InvalidPart     = newS3Error(400, "InvalidPart", "One or more of the specified parts could not be found")
+	errS3MalformedChunk  = newS3Error(400, "IncompleteBody", "The chunked body is malformed")
+	errS3NotImplemented  = newS3Error(501, "NotImplemented", "The requested functionality is not implemented")
+	errS3ContentMismatch = newS3Error(400, "XAmzContentSHA256Mismatch",
+		"The provided 'x-amz-content-sha256' header does not match what was computed")
+	errS3BadDigest = newS3Error(400, "BadDigest", "The Content-MD5 you specified did not match what we received")
+)
+
+// S3 codes of the errors shared with the rest of the server.
+var s3ErrorCodes = map[int]string{
+	403: "AccessDenied",
+	404: "NoSuchKey",
+	413: "EntityTooLarge",
+	507: "InsufficientStorage",
+}
+
+// A multipart upload, stored in the staging directory next to the parts uploaded so far.
+type s3Upload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// The user who created the upload, empty for access keys without one.
+	User string `json:"user"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	// Empty for the default region.
+	Region string `xml:",chardata"`
+}
+
+// The result of ListObjects, or ListObjectsV2 which replaces the markers with KeyCount and continuation tokens.
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// What ListObjects asks for.
+type s3ListQuery struct {
+	prefix    string
+	delimiter string
+	// Keys up to and including marker are skipped, along with those under it if it's a common prefix.
+	marker  string
+	maxKeys int
+	// The last common prefix found, as the keys it rolls up come one after the other.
+	lastPrefix string
+}
+
+// The verified signature of a request, which the chunks of a streamed body are chained to.
+type s3Signature struct {
+	key   []byte
+	date  string
+	scope string
+	// The hex encoded signature of the request.
+	signature string
+	// The x-amz-content-sha256 header, or UNSIGNED-PAYLOAD for presigned URLs.
+	payload string
+}
+
+func (s *Server) s3Prefix() string {
+	return s.opts.Prefix + s.opts.S3
+}
+
+// Adds the S3 routes to group. Requests authenticate with their signature instead of through authChecker.
+func (s *Server) addS3Routes(group *echo.Group) {
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete}
+	group.Match(methods, s.opts.S3, s.handleS3)
+	group.Match(methods, s.opts.S3+"/*", s.handleS3)
+}
+
+// Handles an S3 request, answering errors the way S3 does.
+func (s *Server) handleS3(c echo.Context) error {
+	err := s.serveS3(c)
+	if err == nil {
+		return nil
+	}
+	var s3Err *s3Error
+	var httpErr *echo.HTTPError
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.As(err, &httpErr):
+		code, ok := s3ErrorCodes[httpErr.Code]
+		if !ok && httpErr.Code >= 500 {
+			code = "InternalError"
+		} else if !ok {
+			code = "InvalidRequest"
+		}
+		s3Err = newS3Error(httpErr.Code, code, fmt.Sprint(httpErr.Message))
+	case errors.Is(err, fs.ErrNotExist):
+		s3Err = errS3NoSuchKey
+	case errors.Is(err, fs.ErrPermission):
+		s3Err = errS3AccessDenied
+	default:
+		s.opts.Logger.Error().Err(err).Str("method", c.Request().Method).Str("path", c.Request().URL.Path).Msg("s3")
+		s3Err = newS3Error(500, "InternalError", "We encountered an internal error, please try again")
+	}
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(s3Err.status)
+	}
+	return writeS3XML(c, s3Err.status, s3Err)
+}
+
+// Authenticates an S3 request and dispatches it to the operation it's for.
+func (s *Server) serveS3(c echo.Context) error {
+	sig, err := s.checkS3Signature(c)
+	if err != nil {
+		return err
+	}
+	r := c.Request()
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !s.hasPermission(c, PermRead) {
+		return errS3AccessDenied
+	}
+	bucket, key := splitS3Path(strings.TrimPrefix(r.URL.Path, s.s3Prefix()))
+	query := r.URL.Query()
+	switch {
+	case bucket == "":
+		if r.Method == http.MethodGet && s3QueryIs(query) {
+			return s.s3ListBuckets(c)
+		}
+	case key == "":
+		switch {
+		case r.Method == http.MethodGet && query.Has("location") && s3QueryIs(query, "location"):
+			if _, _, err := s.resolveS3Bucket(c, bucket); err != nil {
+				return err
+			}
+			return writeS3XML(c, 200, &s3LocationConstraint{Xmlns: s3Namespace})
+		case r.Method == http.MethodGet && s3QueryIs(query, s3ListParams...):
+			return s.s3ListObjects(c, bucket)
+		case r.Method == http.MethodHead && s3QueryIs(query):
+			if _, _, err := s.resolveS3Bucket(c, bucket); err != nil {
+				return err
+			}
+			return c.NoContent(200)
+		}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if s3QueryIs(query) {
+			return s.s3GetObject(c, bucket, key)
+		}
+	case r.Method == http.MethodPut:
+		if query.Has("uploadId") && s3QueryIs(query, "uploadId", "partNumber") {
+			return s.s3UploadPart(c, bucket, key, sig)
+		}
+		if s3QueryIs(query) && r.Header.Get("X-Amz-Copy-Source") == "" {
+			return s.s3PutObject(c, bucket, key, sig)
+		}
+	case r.Method == http.MethodPost:
+		if query.Has("uploads") && s3QueryIs(query, "uploads") {
+			return s.s3CreateUpload(c, bucket, key)
+		}
+		if query.Has("uploadId") && s3QueryIs(query, "uploadId") {
+			return s.s3CompleteUpload(c, bucket, key)
+		}
+	case r.Method == http.MethodDelete:
+		if query.Has("uploadId") && s3QueryIs(query, "uploadId") {
+			return s.s3AbortUpload(c, bucket, key)
+		}
+		if s3QueryIs(query) {
+			return s.s3DeleteObject(c, bucket, key)
+		}
+	}
+	return errS3NotImplemented
+}
+
+// Splits a path below the S3 endpoint into the bucket and key it addresses, either of which may be empty.
+func splitS3Path(s3Path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(s3Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Reports whether query has no other parameters than params, besides those of presigned URLs,
+// response header overrides and the operation name that some SDKs add.
+func s3QueryIs(query url.Values, params ...string) bool {
+outer:
+	for name := range query {
+		if strings.HasPrefix(name, "X-Amz-") || strings.HasPrefix(name, "response-") || name == "x-id" {
+			continue
+		}
+		for _, param := range params {
+			if name == param {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func writeS3XML(c echo.Context, status int, v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Blob(status, echo.MIMEApplicationXMLCharsetUTF8, append([]byte(xml.Header), body...))
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// Returns the ETag of a file. S3 clients take ETags with a part count suffix, like those of multipart uploads,
+// for something else than the MD5 of the content, so it can be derived from the size and modification time.
+func s3ETag(info fs.FileInfo) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())))
+	return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+// Authenticates a request signed with AWS Signature Version 4, in its Authorization header or as a presigned URL,
+// and makes the user of its access key the current one.
+func (s *Server) checkS3Signature(c echo.Context) (*s3Signature, error) {
+	r := c.Request()
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payload string
+	presigned := query.Has("X-Amz-Algorithm")
+	if presigned {
+		if query.Get("X-Amz-Algorithm") != s3Algorithm {
+			return nil, newS3Error(400, "AuthorizationQueryParametersError", "Unsupported X-Amz-Algorithm")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payload = s3UnsignedPayload
+	} else {
+		authorization := r.Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(authorization, s3Algorithm+" ") {
+			return nil, errS3AccessDenied
+		}
+		for _, field := range strings.Split(authorization[len(s3Algorithm)+1:], ",") {
+			parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "Credential":
+				credential = parts[1]
+			case "SignedHeaders":
+				signedHeaders = parts[1]
+			case "Signature":
+				signature = parts[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return nil, newS3Error(400, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+		}
+	}
+	// access key, date, region, service and terminator
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return nil, newS3Error(400, "AuthorizationHeaderMalformed", "The credential is malformed")
+	}
+	key, ok := s.opts.S3Keys[scope[0]]
+	if !ok {
+		s.opts.Logger.Warn().Str("access_key", scope[0]).Str("remote_ip", c.RealIP()).Msg("failed login")
+		return nil, newS3Error(403, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records")
+	}
+	date, err := time.Parse(s3DateFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scope[1]) {
+		return nil, newS3Error(400, "AuthorizationHeaderMalformed", "X-Amz-Date is missing or doesn't match the credential")
+	}
+	now := time.Now()
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > s3MaxExpires {
+			return nil, newS3Error(400, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 and 604800")
+		}
+		if now.Before(date.Add(-s3MaxSkew)) || now.After(date.Add(time.Duration(expires)*time.Second)) {
+			return nil, newS3Error(403, "AccessDenied", "Request has expired")
+		}
+	} else if now.Sub(date) > s3MaxSkew || date.Sub(now) > s3MaxSkew {
+		return nil, newS3Error(403, "RequestTimeTooSkewed",
+			"The difference between the request time and the current time is too large")
+	}
+	hasHost := false
+	for _, name := range strings.Split(signedHeaders, ";") {
+		hasHost = hasHost || name == "host"
+	}
+	if !hasHost {
+		return nil, newS3Error(400, "AuthorizationHeaderMalformed", "The host header must be signed")
+	}
+	sig := &s3Signature{
+		key:     s3SigningKey(key.Secret, scope[1], scope[2]),
+		date:    amzDate,
+		scope:   strings.Join(scope[1:], "/"),
+		payload: payload,
+	}
+	expected := sig.signRequest(r, query, signedHeaders, payload)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		s.opts.Logger.Warn().Str("access_key", scope[0]).Str("remote_ip", c.RealIP()).Msg("failed login")
+		return nil, errS3SignatureMismatch
+	}
+	sig.signature = signature
+	if key.User != "" {
+		c.Set("user", key.User)
+	}
+	return sig, nil
+}
+
+// Derives the key that requests signed with secret on date for region are signed with.
+func s3SigningKey(secret string, date string, region string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return key
+}
+
+// Returns the hex encoded signature of lines, which make up the string to sign.
+func (sig *s3Signature) sign(lines ...string) string {
+	mac := hmac.New(sha256.New, sig.key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the signature of a request, from its canonical form as the client built it.
+func (sig *s3Signature) signRequest(r *http.Request, query url.Values, signedHeaders string, payload string) string {
+	canonical := strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, true),
+		s3CanonicalQuery(query),
+		s3CanonicalHeaders(r, strings.Split(signedHeaders, ";")),
+		signedHeaders,
+		payload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	return sig.sign(s3Algorithm, sig.date, sig.scope, hex.EncodeToString(sum[:]))
+}
+
+// Escapes everything but unreserved characters, and slashes in paths, as canonical requests do.
+func s3Escape(str string, isPath bool) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		char := str[i]
+		if 'A' <= char && char <= 'Z' || 'a' <= char && char <= 'z' || '0' <= char && char <= '9' ||
+			char == '-' || char == '_' || char == '.' || char == '~' || char == '/' && isPath {
+			b.WriteByte(char)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", char)
+		}
+	}
+	return b.String()
+}
+
+// Returns the escaped parameters of query sorted by name and value, without the signature itself.
+func s3CanonicalQuery(query url.Values) string {
+	var pairs [][2]string
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, [2]string{s3Escape(name, false), s3Escape(value, false)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	params := make([]string, len(pairs))
+	for i, pair := range pairs {
+		params[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(params, "&")
+}
+
+// Returns the signed headers one per line, with their values trimmed and joined by commas.
+func s3CanonicalHeaders(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		values := r.Header.Values(name)
+		switch {
+		case name == "host":
+			values = []string{r.Host}
+		case name == "content-length" && len(values) == 0 && r.ContentLength >= 0:
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+	return b.String()
+}
+
+// Returns the body of a request to store, and its size or -1 if unknown. Bodies streamed in aws-chunked encoding
+// are decoded. The payload is checked against its signed hash and Content-MD5 while it is read, and reading fails
+// at the end if it doesn't match, so it isn't kept.
+func (s *Server) s3Body(r *http.Request, sig *s3Signature) (io.Reader, int64, error) {
+	var body io.Reader = r.Body
+	size := r.ContentLength
+	switch sig.payload {
+	case s3UnsignedPayload:
+	case "STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER",
+		"STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+		size = -1
+		if decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			size = decoded
+		}
+		chunked := &s3ChunkedReader{r: bufio.NewReader(r.Body), prev: sig.signature}
+		if !strings.HasPrefix(sig.payload, "STREAMING-UNSIGNED-") {
+			chunked.sig = sig
+		}
+		body = chunked
+	default:
+		sum, err := hex.DecodeString(sig.payload)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, 0, newS3Error(400, "InvalidArgument", "x-amz-content-sha256 must be UNSIGNED-PAYLOAD, "+
+				"a supported STREAMING- value or the SHA256 of the payload")
+		}
+		body = &s3VerifyingReader{Reader: body, hash: sha256.New(), sum: sum, err: errS3ContentMismatch}
+	}
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(sum) != md5.Size {
+			return nil, 0, newS3Error(400, "InvalidDigest", "The Content-MD5 you specified is not valid")
+		}
+		body = &s3VerifyingReader{Reader: body, hash: md5.New(), sum: sum, err: errS3BadDigest}
+	}
+	return body, size, nil
+}
+
+// Hashes what is read through it, and fails with err instead of ending if the hash isn't sum.
+type s3VerifyingReader struct {
+	io.Reader
+	hash hash.Hash
+	sum  []byte
+	err  error
+}
+
+func (v *s3VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.hash.Sum(nil), v.sum) {
+		err = v.err
+	}
+	return n, err
+}
+
+// Decodes a body streamed in aws-chunked encoding, checking the signature of each chunk unless they are unsigned.
+// Trailing checksums are skipped.
+type s3ChunkedReader struct {
+	r *bufio.Reader
+	// Nil for unsigned chunks.
+	sig *s3Signature
+	// The signature of the previous chunk, or of the request for the first one.
+	prev string
+	// What is left of the current chunk, its hash so far and the signature it was sent with.
+	left      int64
+	hash      hash.Hash
+	signature string
+	done      bool
+}
+
+func (cr *s3ChunkedReader) Read(p []byte) (int, error) {
+	for cr.left == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	if cr.hash != nil {
+		cr.hash.Write(p[:n])
+	}
+	cr.left -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return n, err
+	}
+	if cr.left == 0 {
+		// the data of a chunk ends with a line break
+		if line, err := cr.readLine(); err != nil || line != "" {
+			return n, errS3MalformedChunk
+		}
+		err = cr.verifyChunk()
+	}
+	return n, err
+}
+
+// Reads the header of the next chunk. The final chunk is empty, and followed by trailers up to an empty line.
+func (cr *s3ChunkedReader) nextChunk() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex := line
+	cr.signature = ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		sizeHex = line[:i]
+		cr.signature = strings.TrimPrefix(line[i+1:], "chunk-signature=")
+	}
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return errS3MalformedChunk
+	}
+	cr.left = size
+	if cr.sig != nil {
+		cr.hash = sha256.New()
+	}
+	if size > 0 {
+		return nil
+	}
+	if err := cr.verifyChunk(); err != nil {
+		return err
+	}
+	for {
+		line, err := cr.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+	}
+	cr.done = true
+	return nil
+}
+
+func (cr *s3ChunkedReader) verifyChunk() error {
+	if cr.sig == nil {
+		return nil
+	}
+	expected := cr.sig.sign(s3Algorithm+"-PAYLOAD", cr.sig.date, cr.sig.scope, cr.prev, s3EmptySHA256,
+		hex.EncodeToString(cr.hash.Sum(nil)))
+	if !hmac.Equal([]byte(expected), []byte(cr.signature)) {
+		return errS3SignatureMismatch
+	}
+	cr.prev = cr.signature
+	return nil
+}
+
+func (cr *s3ChunkedReader) readLine() (string, error) {
+	line, err := cr.r.ReadSlice('\n')
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", errS3MalformedChunk
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Resolves a bucket, which is a folder at the root of the current user.
+func (s *Server) resolveS3Bucket(c echo.Context, bucket string) (string, *Mount, error) {
+	if bucket == "." || bucket == ".." {
+		return "", nil, errS3NoSuchBucket
+	}
+	filePath, mount, err := s.resolveSharePath(c, "/"+bucket)
+	if err != nil || mount == nil {
+		return "", nil, errS3NoSuchBucket
+	}
+	if info, err := s.stat(filePath); err != nil || !info.IsDir() {
+		return "", nil, errS3NoSuchBucket
+	}
+	return filePath, mount, nil
+}
+
+// Resolves an object in a bucket like resolveSharePath. Keys are confined to their bucket and must be the clean path
+// of a file, or of a folder with a trailing slash, so that each file has a single key.
+func (s *Server) resolveS3Object(c echo.Context, bucket string, key string) (string, *Mount, error) {
+	if _, _, err := s.resolveS3Bucket(c, bucket); err != nil {
+		return "", nil, err
+	}
+	if strings.HasPrefix(key, "/") || path.Clean("/"+key) != "/"+strings.TrimSuffix(key, "/") ||
+		strings.ContainsRune(key, 0) || filepath.Separator != '/' && strings.ContainsRune(key, filepath.Separator) {
+		return "", nil, errS3InvalidKey
+	}
+	return s.resolveSharePath(c, "/"+bucket+"/"+key)
+}
+
+// Returns the path storeUpload takes for an object.
+func (s *Server) s3VirtualPath(bucket string, key string) string {
+	return s.opts.Prefix + bucket + "/" + key
+}
+
+// Lists the folders at the root of the current user as buckets.
+func (s *Server) s3ListBuckets(c echo.Context) error {
+	rootPath, _, err := s.resolveSharePath(c, "/")
+	if err != nil {
+		return err
+	}
+	entries, err := s.listShared(rootPath)
+	if err != nil {
+		return err
+	}
+	result := s3ListBucketsResult{Xmlns: s3Namespace}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			result.Buckets = append(result.Buckets, s3Bucket{Name: entry.Name(), CreationDate: s3Time(entry.ModTime())})
+		}
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].Name < result.Buckets[j].Name
+	})
+	return writeS3XML(c, 200, &result)
+}
+
+// Handles ListObjects, and ListObjectsV2 if the list-type parameter is 2.
+// Folders are listed as common prefixes even if they are empty.
+func (s *Server) s3ListObjects(c echo.Context, bucket string) error {
+	bucketPath, _, err := s.resolveS3Bucket(c, bucket)
+	if err != nil {
+		return err
+	}
+	list := s3ListQuery{prefix: c.QueryParam("prefix"), delimiter: c.QueryParam("delimiter"), maxKeys: 1000}
+	if maxKeys := c.QueryParam("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			return newS3Error(400, "InvalidArgument", "max-keys must be a non-negative integer")
+		}
+		if n < list.maxKeys {
+			list.maxKeys = n
+		}
+	}
+	result := s3ListBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    list.prefix,
+		Delimiter: list.delimiter,
+		MaxKeys:   list.maxKeys,
+	}
+	v2 := c.QueryParam("list-type") == "2"
+	if v2 {
+		result.StartAfter = c.QueryParam("start-after")
+		list.marker = result.StartAfter
+		if token := c.QueryParam("continuation-token"); token != "" {
+			marker, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return newS3Error(400, "InvalidArgument", "The continuation token provided is incorrect")
+			}
+			list.marker = string(marker)
+			result.ContinuationToken = token
+		}
+	} else {
+		marker := c.QueryParam("marker")
+		result.Marker = &marker
+		list.marker = marker
+	}
+	last := ""
+	_, err = s.walkS3(bucketPath, "", &list, func(key string, info fs.FileInfo) bool {
+		if len(result.Contents)+len(result.CommonPrefixes) == list.maxKeys {
+			result.IsTruncated = true
+			return false
+		}
+		if info == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{key})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          key,
+				LastModified: s3Time(info.ModTime()),
+				ETag:         s3ETag(info),
+				Size:         info.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		last = key
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if result.IsTruncated && v2 {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	} else if result.IsTruncated {
+		result.NextMarker = last
+	}
+	if v2 {
+		keyCount := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &keyCount
+	}
+	if c.QueryParam("encoding-type") == "url" {
+		result.EncodingType = "url"
+		for _, value := range []*string{&result.Prefix, &result.Delimiter, &result.StartAfter, &result.NextMarker} {
+			*value = url.QueryEscape(*value)
+		}
+		for i := range result.Contents {
+			result.Contents[i].Key = url.QueryEscape(result.Contents[i].Key)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = url.QueryEscape(result.CommonPrefixes[i].Prefix)
+		}
+	}
+	return writeS3XML(c, 200, &result)
+}
+
+// Walks the objects of the folder at dirPath, whose keys start with keyPrefix, in the order of their keys.
+// Passes those matching list to emit, or the common prefixes that roll them up with a nil info, until it returns
+// false. Only regular files are objects. Folders that can't hold a match or that are rolled up aren't walked.
+func (s *Server) walkS3(dirPath string, keyPrefix string, list *s3ListQuery,
+	emit func(key string, info fs.FileInfo) bool) (bool, error) {
+	type s3Entry struct {
+		key  string
+		info fs.FileInfo
+	}
+	infos, err := s.listShared(dirPath)
+	if err != nil {
+		return false, err
+	}
+	entries := make([]s3Entry, len(infos))
+	for i, info := range infos {
+		entries[i] = s3Entry{keyPrefix + info.Name(), info}
+		if info.IsDir() {
+			entries[i].key += "/"
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	for _, entry := range entries {
+		key := entry.key
+		if entry.info.IsDir() {
+			if !strings.HasPrefix(key, list.prefix) && !strings.HasPrefix(list.prefix, key) {
+				continue
+			}
+			// all keys in the folder come before the marker
+			if key < list.marker && !strings.HasPrefix(list.marker, key) {
+				continue
+			}
+			// the folder is the first one past the prefix, so it rolls up everything in it
+			if list.delimiter == "/" && len(key) > len(list.prefix) && strings.HasPrefix(key, list.prefix) {
+				if key > list.marker && !emit(key, nil) {
+					return false, nil
+				}
+				continue
+			}
+			more, err := s.walkS3(filepath.Join(dirPath, entry.info.Name()), key, list, emit)
+			if err != nil || !more {
+				return more, err
+			}
+			continue
+		}
+		if !entry.info.Mode().IsRegular() || !strings.HasPrefix(key, list.prefix) {
+			continue
+		}
+		if list.delimiter != "" {
+			if i := strings.Index(key[len(list.prefix):], list.delimiter); i >= 0 {
+				commonPrefix := key[:len(list.prefix)+i+len(list.delimiter)]
+				if commonPrefix <= list.marker || commonPrefix == list.lastPrefix {
+					continue
+				}
+				list.lastPrefix = commonPrefix
+				if !emit(commonPrefix, nil) {
+					return false, nil
+				}
+				continue
+			}
+		}
+		if key > list.marker && !emit(key, entry.info) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Handles GetObject and HeadObject, supporting ranges and conditional requests.
+func (s *Server) s3GetObject(c echo.Context, bucket string, key string) error {
+	filePath, _, err := s.resolveS3Object(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	info, err := s.stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+		return errS3NoSuchKey
+	} else if err != nil {
+		return err
+	}
+	file, err := s.storage.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header := c.Response().Header()
+	header.Set("ETag", s3ETag(info))
+	s.setCustomContentType(c, filePath)
+	for param, name := range s3ResponseHeaders {
+		if value := c.QueryParam(param); value != "" {
+			header.Set(name, value)
+		}
+	}
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), file)
+	return nil
+}
+
+// Handles PutObject. An object with a trailing slash in its key stands for a folder, which is created instead.
+func (s *Server) s3PutObject(c echo.Context, bucket string, key string, sig *s3Signature) error {
+	filePath, mount, err := s.resolveS3Object(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, "/") {
+		if !s.hasPermission(c, PermMkdir) || !s.writable(mount) {
+			return errS3AccessDenied
+		}
+		if err := s.storage.MkdirAll(filePath, os.ModePerm); err != nil {
+			return err
+		}
+		emptySum := md5.Sum(nil)
+		c.Response().Header().Set("ETag", `"`+hex.EncodeToString(emptySum[:])+`"`)
+		return c.NoContent(200)
+	}
+	if !s.hasPermission(c, PermUpload) {
+		return errS3AccessDenied
+	}
+	if info, err := s.stat(filePath); err == nil && info.IsDir() {
+		return errS3KeyIsFolder
+	}
+	body, size, err := s.s3Body(c.Request(), sig)
+	if err != nil {
+		return err
+	}
+	if _, err := s.storeUpload(c, s.s3VirtualPath(bucket, key), body, size, size, ConflictOverwrite); err != nil {
+		return err
+	}
+	info, err := s.storage.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", s3ETag(info))
+	return c.NoContent(200)
+}
+
+// Handles DeleteObject. Deleting an object that doesn't exist succeeds, as does deleting the key of a folder
+// that still has files in it, since it doesn't go away in S3 either.
+func (s *Server) s3DeleteObject(c echo.Context, bucket string, key string) error {
+	if !s.hasPermission(c, PermRm) {
+		return errS3AccessDenied
+	}
+	filePath, mount, err := s.resolveS3Object(c, bucket, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c.NoContent(204)
+	} else if err != nil {
+		return err
+	}
+	if !s.writable(mount) || filePath == mount.Path {
+		return errS3AccessDenied
+	}
+	info, err := s.stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c.NoContent(204)
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() != strings.HasSuffix(key, "/") {
+		return c.NoContent(204)
+	}
+	if info.IsDir() {
+		if entries, err := s.storage.ReadDir(filePath); err == nil && len(entries) > 0 {
+			return c.NoContent(204)
+		}
+	}
+	if err := s.storage.Remove(filePath); err != nil {
+		return err
+	}
+	s.indexRemoved(filePath)
+	s.pruneThumbnailsOf(filePath)
+	return c.NoContent(204)
+}
+
+func (s *Server) s3UploadDir(id string) string {
+	return filepath.Join(s.opts.StagingDir, id+".s3")
+}
+
+// Handles CreateMultipartUpload. The parts are kept in the staging directory until the upload is completed.
+func (s *Server) s3CreateUpload(c echo.Context, bucket string, key string) error {
+	if !s.hasPermission(c, PermUpload) {
+		return errS3AccessDenied
+	}
+	// fail early instead of after all parts have been sent
+	filePath, mount, err := s.resolveS3Object(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, "/") {
+		return errS3InvalidKey
+	}
+	if !s.writable(mount) || filePath == mount.Path {
+		return errS3AccessDenied
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(idBytes)
+	upload := s3Upload{Bucket: bucket, Key: key}
+	if username, ok := c.Get("user").(string); ok {
+		upload.User = username
+	}
+	info, err := json.Marshal(&upload)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.s3UploadDir(id), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.s3UploadDir(id), "upload.json"), info, 0600); err != nil {
+		return err
+	}
+	return writeS3XML(c, 200, &s3InitiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: id})
+}
+
+// Loads the multipart upload of an object, which only its creator may access. Returns its staging directory.
+func (s *Server) loadS3Upload(c echo.Context, bucket string, key string) (string, error) {
+	id := c.QueryParam("uploadId")
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", errS3NoSuchUpload
+	}
+	data, err := os.ReadFile(filepath.Join(s.s3UploadDir(id), "upload.json"))
+	if err != nil {
+		return "", errS3NoSuchUpload
+	}
+	var upload s3Upload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return "", errS3NoSuchUpload
+	}
+	username, _ := c.Get("user").(string)
+	if upload.User != username || upload.Bucket != bucket || upload.Key != key {
+		return "", errS3NoSuchUpload
+	}
+	return s.s3UploadDir(id), nil
+}
+
+// Handles UploadPart, which answers with the MD5 of the part as its ETag.
+func (s *Server) s3UploadPart(c echo.Context, bucket string, key string, sig *s3Signature) error {
+	if !s.hasPermission(c, PermUpload) {
+		return errS3AccessDenied
+	}
+	dir, err := s.loadS3Upload(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	partNumber, err := strconv.Atoi(c.QueryParam("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		return newS3Error(400, "InvalidArgument", "Part number must be an integer between 1 and 10000")
+	}
+	body, size, err := s.s3Body(c.Request(), sig)
+	if err != nil {
+		return err
+	}
+	if err := s.checkStagingLimits(size); err != nil {
+		return err
+	}
+	sum := md5.New()
+	err = writeAtomic(LocalStorage{}, filepath.Join(dir, strconv.Itoa(partNumber)), func(file File) error {
+		_, err := s.copyUpload(io.MultiWriter(file, sum), body)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	return c.NoContent(200)
+}
+
+// Handles CompleteMultipartUpload, storing the listed parts one after the other like any other upload.
+func (s *Server) s3CompleteUpload(c echo.Context, bucket string, key string) error {
+	if !s.hasPermission(c, PermUpload) {
+		return errS3AccessDenied
+	}
+	dir, err := s.loadS3Upload(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	body, err := s.readRPCBody(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	var complete s3CompleteMultipartUpload
+	if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+		return newS3Error(400, "MalformedXML", "The XML you provided was not well-formed")
+	}
+	parts := &s3PartsReader{}
+	defer parts.Close()
+	size := int64(0)
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			return newS3Error(400, "InvalidPartOrder", "The list of parts was not in ascending order")
+		}
+		partPath := filepath.Join(dir, strconv.Itoa(part.PartNumber))
+		info, err := os.Stat(partPath)
+		if err != nil {
+			return errS3InvalidPart
+		}
+		size += info.Size()
+		parts.paths = append(parts.paths, partPath)
+		parts.etags = append(parts.etags, strings.Trim(part.ETag, `"`))
+	}
+	filePath, _, err := s.resolveS3Object(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	if info, err := s.stat(filePath); err == nil && info.IsDir() {
+		return errS3KeyIsFolder
+	}
+	if _, err := s.storeUpload(c, s.s3VirtualPath(bucket, key), parts, size, size, ConflictOverwrite); err != nil {
+		return err
+	}
+	parts.Close()
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	info, err := s.storage.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	return writeS3XML(c, 200, &s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: c.Scheme() + "://" + c.Request().Host + c.Request().URL.Path,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     s3ETag(info),
+	})
+}
+
+// Handles AbortMultipartUpload, discarding the parts uploaded so far.
+func (s *Server) s3AbortUpload(c echo.Context, bucket string, key string) error {
+	if !s.hasPermission(c, PermUpload) {
+		return errS3AccessDenied
+	}
+	dir, err := s.loadS3Upload(c, bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
+
+// Reads the parts of a multipart upload one after the other, failing if one doesn't match the ETag it was
+// uploaded with. Only one part is open at a time.
+type s3PartsReader struct {
+	paths []string
+	etags []string
+	file  *os.File
+	hash  hash.Hash
+}
+
+func (pr *s3PartsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.file == nil {
+			if len(pr.paths) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(pr.paths[0])
+			if err != nil {
+				return 0, errS3InvalidPart
+			}
+			pr.file = file
+			pr.hash = md5.New()
+		}
+		n, err := pr.file.Read(p)
+		pr.hash.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		pr.file.Close()
+		pr.file = nil
+		if hex.EncodeToString(pr.hash.Sum(nil)) != pr.etags[0] {
+			return n, errS3InvalidPart
+		}
+		pr.paths, pr.etags = pr.paths[1:], pr.etags[1:]
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (pr *s3PartsReader) Close() error {
+	if pr.file == nil {
+		return nil
+	}
+	err := pr.file.Close()
+	pr.file = nil
+	return err
+}
@@ -0,0 +1,367 @@
+package gosses
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signs a request to the S3 API like AWS SDKs do, with payload as its x-amz-content-sha256 header.
+func s3Sign(req *http.Request, keyID string, secret string, payload string) {
+	now := time.Now().UTC()
+	sig := &s3Signature{
+		key:   s3SigningKey(secret, now.Format("20060102"), "us-east-1"),
+		date:  now.Format(s3DateFormat),
+		scope: now.Format("20060102") + "/us-east-1/s3/aws4_request",
+	}
+	req.Host = req.URL.Host
+	req.Header.Set("X-Amz-Date", sig.date)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm,
+		keyID, sig.scope, signedHeaders, sig.signRequest(req, req.URL.Query(), signedHeaders, payload)))
+}
+
+// Sends a signed request to the S3 API, with the SHA256 of body as payload hash unless headers set another one.
+func s3Do(t *testing.T, keyID string, method string, url string, headers map[string]string, body string) (int, string, http.Header) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	dieMaybe(t, err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	sum := sha256.Sum256([]byte(body))
+	payload := hex.EncodeToString(sum[:])
+	if value, ok := headers["X-Amz-Content-Sha256"]; ok {
+		payload = value
+	}
+	s3Sign(req, keyID, "secret-"+keyID, payload)
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	dieMaybe(t, err)
+	return resp.StatusCode, string(bodyBytes), resp.Header
+}
+
+func TestS3Signature(t *testing.T) {
+	// examples from https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+	// and https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+	fmt.Println("========== testing s3 signature ============")
+	sig := &s3Signature{
+		key:   s3SigningKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524", "us-east-1"),
+		date:  "20130524T000000Z",
+		scope: "20130524/us-east-1/s3/aws4_request",
+	}
+	req := httptest.NewRequest("GET", "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptySHA256)
+	req.Header.Set("X-Amz-Date", sig.date)
+	signature := sig.signRequest(req, req.URL.Query(), "host;range;x-amz-content-sha256;x-amz-date", s3EmptySHA256)
+	if signature != "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41" {
+		t.Fatal("wrong signature", signature)
+	}
+
+	fmt.Println("========== testing s3 chunked body ============")
+	req = httptest.NewRequest("PUT", "http://s3.amazonaws.com/examplebucket/chunkObject.txt", nil)
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	req.Header.Set("Content-Length", "66824")
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	req.Header.Set("X-Amz-Date", sig.date)
+	req.Header.Set("X-Amz-Decoded-Content-Length", "66560")
+	req.Header.Set("X-Amz-Storage-Class", "REDUCED_REDUNDANCY")
+	sig.payload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	sig.signature = sig.signRequest(req, req.URL.Query(), "content-encoding;content-length;host;x-amz-content-sha256;"+
+		"x-amz-date;x-amz-decoded-content-length;x-amz-storage-class", sig.payload)
+	if sig.signature != "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9" {
+		t.Fatal("wrong seed signature", sig.signature)
+	}
+	chunked := "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" +
+		strings.Repeat("a", 65536) + "\r\n" +
+		"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" +
+		strings.Repeat("a", 1024) + "\r\n" +
+		"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+	req.Body = ioutil.NopCloser(strings.NewReader(chunked))
+	body, size, err := (&Server{}).s3Body(req, sig)
+	dieMaybe(t, err)
+	content, err := ioutil.ReadAll(body)
+	dieMaybe(t, err)
+	if size != 66560 || string(content) != strings.Repeat("a", 66560) {
+		t.Fatal("wrong decoded body", size, len(content))
+	}
+	tampered := strings.Replace(chunked, "\r\n"+strings.Repeat("a", 1024), "\r\nb"+strings.Repeat("a", 1023), 1)
+	req.Body = ioutil.NopCloser(strings.NewReader(tampered))
+	body, _, err = (&Server{}).s3Body(req, sig)
+	dieMaybe(t, err)
+	if _, err := ioutil.ReadAll(body); err != errS3SignatureMismatch {
+		t.Fatal("tampered chunk accepted", err)
+	}
+}
+
+func TestS3(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, "photos", "2020"), 0755))
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, "docs"), 0755))
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, ".hidden"), 0755))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "b.txt"), []byte("not a bucket"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "photos", "a.txt"), []byte("hello"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "photos", ".secret"), []byte("hidden"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "photos", "2020", "c.txt"), []byte("world"), 0644))
+	keysFile := filepath.Join(t.TempDir(), "s3keys")
+	dieMaybe(t, os.WriteFile(keysFile, []byte("# keys\nalice:secret-alice\nbob:secret-bob:bob\neve:not-her-secret\n"), 0644))
+
+	fmt.Println("========== testing s3 keys ============")
+	keys, err := LoadS3Keys(keysFile)
+	dieMaybe(t, err)
+	if keys["alice"].Secret != "secret-alice" || keys["bob"].User != "bob" {
+		t.Fatal("wrong keys", keys)
+	}
+	if _, err := New(Options{Root: scratch, S3: "s3"}); err == nil {
+		t.Fatal("s3 without keys accepted")
+	}
+
+	server, err := New(Options{
+		Root:       scratch,
+		SkipHidden: true,
+		S3:         "/s3/",
+		S3Keys:     keys,
+		Profiles:   map[string]Profile{"bob": {Perms: PermRead}},
+		StagingDir: t.TempDir(),
+		MimeTypes:  map[string]string{"txt": "text/x-notes"},
+		Conflict:   ConflictReject,
+	})
+	dieMaybe(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	url := ts.URL + "/s3/"
+
+	fmt.Println("========== testing s3 auth ============")
+	if resp, err := http.Get(url + "photos/a.txt"); err != nil || resp.StatusCode != 403 {
+		t.Fatal("anonymous request accepted", err)
+	}
+	// eve's secret isn't the one s3Do signs with
+	code, body, _ := s3Do(t, "eve", "GET", url+"photos/a.txt", nil, "")
+	if code != 403 || !strings.Contains(body, "<Code>SignatureDoesNotMatch</Code>") {
+		t.Fatal("wrong secret accepted", code, body)
+	}
+	if code, _, _ = s3Do(t, "mallory", "GET", url+"photos/a.txt", nil, ""); code != 403 {
+		t.Fatal("unknown key accepted", code)
+	}
+
+	fmt.Println("========== testing s3 listing ============")
+	code, body, _ = s3Do(t, "alice", "GET", url, nil, "")
+	if code != 200 || !strings.Contains(body, "<Name>docs</Name>") || !strings.Contains(body, "<Name>photos</Name>") ||
+		strings.Contains(body, "b.txt") || strings.Contains(body, ".hidden") {
+		t.Fatal("wrong buckets", code, body)
+	}
+	keyPattern := regexp.MustCompile(`<(?:Key|Prefix)>([^<]+)</`)
+	listKeys := func(query string) ([]string, string) {
+		code, body, _ := s3Do(t, "alice", "GET", url+"photos?"+query, nil, "")
+		if code != 200 {
+			t.Fatal("listing failed", code, body)
+		}
+		var found []string
+		for _, match := range keyPattern.FindAllStringSubmatch(body, -1) {
+			found = append(found, match[1])
+		}
+		return found, body
+	}
+	if found, _ := listKeys("list-type=2"); strings.Join(found, ",") != "2020/c.txt,a.txt" {
+		t.Fatal("wrong objects", found)
+	}
+	if found, _ := listKeys("list-type=2&delimiter=%2F"); strings.Join(found, ",") != "a.txt,2020/" {
+		t.Fatal("wrong objects with delimiter", found)
+	}
+	if found, _ := listKeys("list-type=2&prefix=2020%2F"); strings.Join(found, ",") != "2020/,2020/c.txt" {
+		t.Fatal("wrong objects with prefix", found)
+	}
+	found, page := listKeys("list-type=2&max-keys=1")
+	token := regexp.MustCompile(`<NextContinuationToken>([^<]+)</`).FindStringSubmatch(page)
+	if strings.Join(found, ",") != "2020/c.txt" || !strings.Contains(page, "<IsTruncated>true</IsTruncated>") || token == nil {
+		t.Fatal("wrong first page", found, page)
+	}
+	if found, page = listKeys("list-type=2&max-keys=1&continuation-token=" + token[1]); strings.Join(found, ",") != "a.txt" ||
+		!strings.Contains(page, "<IsTruncated>false</IsTruncated>") {
+		t.Fatal("wrong second page", found, page)
+	}
+	if found, _ := listKeys("marker=2020%2Fc.txt"); strings.Join(found, ",") != "a.txt" {
+		t.Fatal("wrong objects after marker", found)
+	}
+	if code, _, _ = s3Do(t, "alice", "GET", url+"b.txt?list-type=2", nil, ""); code != 404 {
+		t.Fatal("file listed as bucket", code)
+	}
+
+	fmt.Println("========== testing s3 reads ============")
+	code, body, header := s3Do(t, "alice", "GET", url+"photos/a.txt", map[string]string{"Range": "bytes=1-2"}, "")
+	if code != 206 || body != "el" || header.Get("Content-Type") != "text/x-notes" || header.Get("ETag") == "" {
+		t.Fatal("wrong range", code, body, header)
+	}
+	if code, _, _ = s3Do(t, "alice", "HEAD", url+"photos/2020/c.txt", nil, ""); code != 200 {
+		t.Fatal("head failed", code)
+	}
+	for _, key := range []string{"photos/.secret", "photos/missing.txt", "photos/2020", "photos/2020/"} {
+		if code, _, _ = s3Do(t, "alice", "GET", url+key, nil, ""); code != 404 {
+			t.Fatal("found", key, code)
+		}
+	}
+	for _, key := range []string{"photos/2020/../../b.txt", "photos//a.txt", "photos/./a.txt"} {
+		if code, _, _ = s3Do(t, "alice", "GET", url+key, nil, ""); code != 400 {
+			t.Fatal("unclean key accepted", key, code)
+		}
+	}
+
+	fmt.Println("========== testing s3 presigned url ============")
+	now := time.Now().UTC()
+	presign := func(expires string) string {
+		query := "X-Amz-Algorithm=" + s3Algorithm + "&X-Amz-Credential=alice%2F" + now.Format("20060102") +
+			"%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Date=" + now.Format(s3DateFormat) + "&X-Amz-Expires=" + expires +
+			"&X-Amz-SignedHeaders=host"
+		req, err := http.NewRequest("GET", url+"photos/a.txt?"+query, nil)
+		dieMaybe(t, err)
+		req.Host = req.URL.Host
+		sig := &s3Signature{
+			key:   s3SigningKey("secret-alice", now.Format("20060102"), "us-east-1"),
+			date:  now.Format(s3DateFormat),
+			scope: now.Format("20060102") + "/us-east-1/s3/aws4_request",
+		}
+		return req.URL.String() + "&X-Amz-Signature=" + sig.signRequest(req, req.URL.Query(), "host", s3UnsignedPayload)
+	}
+	if body := get(t, presign("60")); body != "hello" {
+		t.Fatal("presigned url failed", body)
+	}
+	if resp, err := http.Get(presign("0")); err != nil || resp.StatusCode != 400 {
+		t.Fatal("invalid expiry accepted", err)
+	}
+
+	fmt.Println("========== testing s3 writes ============")
+	if code, _, header = s3Do(t, "alice", "PUT", url+"photos/new/d.txt", nil, "some content"); code != 200 || header.Get("ETag") == "" {
+		t.Fatal("put failed", code)
+	}
+	if content, _ := os.ReadFile(filepath.Join(scratch, "photos", "new", "d.txt")); string(content) != "some content" {
+		t.Fatal("wrong put content", string(content))
+	}
+	// the conflict policy doesn't apply
+	if code, _, _ = s3Do(t, "alice", "PUT", url+"photos/a.txt", nil, "replaced"); code != 200 {
+		t.Fatal("overwrite failed", code)
+	}
+	code, body, _ = s3Do(t, "alice", "PUT", url+"photos/bad.txt", map[string]string{"X-Amz-Content-Sha256": s3EmptySHA256}, "content")
+	if _, err := os.Stat(filepath.Join(scratch, "photos", "bad.txt")); code != 400 ||
+		!strings.Contains(body, "XAmzContentSHA256Mismatch") || !os.IsNotExist(err) {
+		t.Fatal("payload mismatch accepted", code, body)
+	}
+	wrongMD5 := md5.Sum([]byte("other"))
+	headers := map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(wrongMD5[:])}
+	if code, _, _ = s3Do(t, "alice", "PUT", url+"photos/bad.txt", headers, "content"); code != 400 {
+		t.Fatal("digest mismatch accepted", code)
+	}
+	if code, _, _ = s3Do(t, "alice", "PUT", url+"photos/../b.txt", nil, "escaped"); code != 400 {
+		t.Fatal("key escaped its bucket", code)
+	}
+	if code, _, _ = s3Do(t, "alice", "PUT", url+"photos/empty/", nil, ""); code != 200 {
+		t.Fatal("folder marker failed", code)
+	}
+	if info, err := os.Stat(filepath.Join(scratch, "photos", "empty")); err != nil || !info.IsDir() {
+		t.Fatal("folder not created", err)
+	}
+	if code, _, _ = s3Do(t, "alice", "DELETE", url+"photos/empty/", nil, ""); code != 204 {
+		t.Fatal("folder delete failed", code)
+	}
+	if code, _, _ = s3Do(t, "alice", "DELETE", url+"photos/new/d.txt", nil, ""); code != 204 {
+		t.Fatal("delete failed", code)
+	}
+	if _, err := os.Stat(filepath.Join(scratch, "photos", "new", "d.txt")); !os.IsNotExist(err) {
+		t.Fatal("file not deleted")
+	}
+	if _, err := os.Stat(filepath.Join(scratch, "photos", "empty")); !os.IsNotExist(err) {
+		t.Fatal("empty folder not deleted")
+	}
+	if code, _, _ = s3Do(t, "alice", "DELETE", url+"photos/missing.txt", nil, ""); code != 204 {
+		t.Fatal("delete of missing object failed", code)
+	}
+	if code, _, _ = s3Do(t, "alice", "PUT", url+"photos/a.txt", map[string]string{"X-Amz-Copy-Source": "/photos/b.txt"}, ""); code != 501 {
+		t.Fatal("copy not rejected", code)
+	}
+
+	fmt.Println("========== testing s3 multipart upload ============")
+	code, body, _ = s3Do(t, "alice", "POST", url+"photos/big.bin?uploads", nil, "")
+	uploadID := regexp.MustCompile(`<UploadId>([0-9a-f]+)</`).FindStringSubmatch(body)
+	if code != 200 || uploadID == nil {
+		t.Fatal("create upload failed", code, body)
+	}
+	uploadURL := url + "photos/big.bin?uploadId=" + uploadID[1]
+	var etags []string
+	for i, part := range []string{"first ", "second"} {
+		code, _, header = s3Do(t, "alice", "PUT", fmt.Sprintf("%s&partNumber=%d", uploadURL, i+1), nil, part)
+		if code != 200 {
+			t.Fatal("upload part failed", code)
+		}
+		etags = append(etags, header.Get("ETag"))
+	}
+	if code, _, _ = s3Do(t, "bob", "PUT", uploadURL+"&partNumber=3", nil, "bob"); code != 403 {
+		t.Fatal("part of another user accepted", code)
+	}
+	complete := func(etags ...string) (int, string) {
+		xml := "<CompleteMultipartUpload>"
+		for i, etag := range etags {
+			xml += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etag)
+		}
+		code, body, _ := s3Do(t, "alice", "POST", uploadURL, nil, xml+"</CompleteMultipartUpload>")
+		return code, body
+	}
+	if code, body = complete(etags[0], etags[0]); code != 400 || !strings.Contains(body, "InvalidPart") {
+		t.Fatal("wrong part accepted", code, body)
+	}
+	if _, err := os.Stat(filepath.Join(scratch, "photos", "big.bin")); !os.IsNotExist(err) {
+		t.Fatal("failed upload kept")
+	}
+	if code, body = complete(etags...); code != 200 || !strings.Contains(body, "<Key>big.bin</Key>") {
+		t.Fatal("complete failed", code, body)
+	}
+	if content, _ := os.ReadFile(filepath.Join(scratch, "photos", "big.bin")); string(content) != "first second" {
+		t.Fatal("wrong multipart content", string(content))
+	}
+	if code, _ = complete(etags...); code != 404 {
+		t.Fatal("upload completed twice", code)
+	}
+	code, body, _ = s3Do(t, "alice", "POST", url+"photos/aborted.bin?uploads", nil, "")
+	uploadID = regexp.MustCompile(`<UploadId>([0-9a-f]+)</`).FindStringSubmatch(body)
+	if code, _, _ = s3Do(t, "alice", "DELETE", url+"photos/aborted.bin?uploadId="+uploadID[1], nil, ""); code != 204 {
+		t.Fatal("abort failed", code)
+	}
+	if _, err := os.Stat(server.s3UploadDir(uploadID[1])); !os.IsNotExist(err) {
+		t.Fatal("aborted upload kept")
+	}
+
+	fmt.Println("========== testing s3 permissions ============")
+	if code, _, _ = s3Do(t, "bob", "GET", url+"photos/a.txt", nil, ""); code != 200 {
+		t.Fatal("read without permission", code)
+	}
+	if code, _, _ = s3Do(t, "bob", "PUT", url+"photos/bob.txt", nil, "bob"); code != 403 {
+		t.Fatal("put without permission", code)
+	}
+	if code, _, _ = s3Do(t, "bob", "DELETE", url+"photos/a.txt", nil, ""); code != 403 {
+		t.Fatal("delete without permission", code)
+	}
+	autoServe(t, Options{
+		Mounts: []Mount{{Name: "docs", Path: filepath.Join(scratch, "docs"), ReadOnly: true}},
+		S3:     "s3",
+		S3Keys: keys,
+	}, func(url string) {
+		if code, body, _ := s3Do(t, "alice", "GET", url+"/s3/", nil, ""); code != 200 || !strings.Contains(body, "<Name>docs</Name>") {
+			t.Fatal("mounts not listed as buckets", code, body)
+		}
+		if code, _, _ := s3Do(t, "alice", "PUT", url+"/s3/docs/e.txt", nil, "content"); code != 403 {
+			t.Fatal("read-only mount written", code)
+		}
+	})
+}
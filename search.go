@@ -0,0 +1,218 @@
+package gosses
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of results returned by default, and at most.
+	defaultSearchLimit = 1000
+	maxSearchLimit     = 10000
+	// Searches stop after this long, so huge trees can't tie up the server.
+	searchTimeout = 30 * time.Second
+)
+
+// Stops a walk once the search is over.
+var errSearchDone = errors.New("search done")
+
+// Criteria of a search, from the query parameters of the request.
+type searchQuery struct {
+	// Pattern for names, as in filepath.Match.
+	glob  string
+	regex *regexp.Regexp
+	// Only files with one of these extensions match.
+	exts    map[string]bool
+	minSize int64
+	maxSize int64
+	after   time.Time
+	before  time.Time
+	limit   int
+}
+
+// A search match, streamed as a line of JSON.
+type searchResult struct {
+	// Path of the match, relative to the root of the current user.
+	Path string `json:"path"`
+	listEntry
+}
+
+// The last line of a search.
+type searchSummary struct {
+	Done  bool `json:"done"`
+	Count int  `json:"count"`
+	// Set if the search stopped at the limit or timeout before walking the whole tree.
+	Truncated bool `json:"truncated"`
+}
+
+// Handles a recursive search below the directory in the path parameter.
+// Matches are streamed as JSON lines as soon as they are found, followed by a summary.
+func (s *Server) handleSearch(c echo.Context) error {
+	query, err := parseSearchQuery(c)
+	if err != nil {
+		return err
+	}
+	virtualDir := filepath.ToSlash(s.cleanPath(c.QueryParam("path")))
+	dirPath, _, err := s.resolveCleanPath(c, virtualDir)
+	if os.IsNotExist(err) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	// pairs of the virtual path and the path on disk of each directory to walk
+	roots := [][2]string{{virtualDir, dirPath}}
+	if dirPath == "" {
+		// the virtual root, search every mount under its name
+		roots = nil
+		for _, mount := range s.mounts {
+			if !s.opts.SkipHidden || !strings.HasPrefix(mount.Name, ".") {
+				roots = append(roots, [2]string{path.Join(virtualDir, mount.Name), mount.Path})
+			}
+		}
+	} else if stat, err := s.stat(dirPath); err != nil || !stat.IsDir() {
+		return errNotFound
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(200)
+	encoder := json.NewEncoder(c.Response())
+	deadline := time.Now().Add(searchTimeout)
+	summary := searchSummary{Done: true}
+	for _, root := range roots {
+		virtualRoot, rootPath := root[0], root[1]
+		err := s.walk(rootPath, func(filePath string, info fs.FileInfo, err error) error {
+			if c.Request().Context().Err() != nil || time.Now().After(deadline) || summary.Count >= query.limit {
+				summary.Truncated = true
+				return errSearchDone
+			}
+			// unreadable entries are skipped rather than failing the whole search
+			if err != nil || filePath == rootPath {
+				return nil
+			}
+			name := info.Name()
+			if s.opts.SkipHidden && strings.HasPrefix(name, ".") || strings.HasPrefix(name, tempFilePrefix) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !query.matches(info) {
+				return nil
+			}
+			rel, err := filepath.Rel(rootPath, filePath)
+			if err != nil {
+				return nil
+			}
+			result := searchResult{
+				Path:      path.Join(virtualRoot, filepath.ToSlash(rel)),
+				listEntry: newListEntry(name, info, info.Mode()&fs.ModeSymlink != 0),
+			}
+			result.Href = s.opts.Prefix + strings.TrimPrefix(result.Path, "/")
+			if info.IsDir() {
+				result.Href += "/"
+			}
+			result.Href = (&url.URL{Path: result.Href}).EscapedPath()
+			if err := encoder.Encode(&result); err != nil {
+				return err
+			}
+			c.Response().Flush()
+			summary.Count++
+			return nil
+		})
+		if errors.Is(err, errSearchDone) {
+			break
+		} else if err != nil {
+			s.opts.Logger.Warn().Err(err).Str("path", rootPath).Msg("search failed")
+			summary.Truncated = true
+			break
+		}
+	}
+	return encoder.Encode(&summary)
+}
+
+// Parses the glob, regex, ext, minSize, maxSize, after, before and limit query parameters.
+// Times are in RFC 3339 format.
+func parseSearchQuery(c echo.Context) (searchQuery, error) {
+	query := searchQuery{glob: c.QueryParam("glob"), limit: defaultSearchLimit}
+	if _, err := filepath.Match(query.glob, ""); err != nil {
+		return query, echo.NewHTTPError(400, "invalid glob")
+	}
+	if regex := c.QueryParam("regex"); regex != "" {
+		var err error
+		if query.regex, err = regexp.Compile(regex); err != nil {
+			return query, echo.NewHTTPError(400, "invalid regex: "+err.Error())
+		}
+	}
+	for _, ext := range strings.Split(c.QueryParam("ext"), ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			if query.exts == nil {
+				query.exts = map[string]bool{}
+			}
+			query.exts[ext] = true
+		}
+	}
+	for name, value := range map[string]*int64{"minSize": &query.minSize, "maxSize": &query.maxSize} {
+		if param := c.QueryParam(name); param != "" {
+			size, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || size < 0 {
+				return query, echo.NewHTTPError(400, name+" must be a positive number of bytes")
+			}
+			*value = size
+		}
+	}
+	for name, value := range map[string]*time.Time{"after": &query.after, "before": &query.before} {
+		if param := c.QueryParam(name); param != "" {
+			date, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return query, echo.NewHTTPError(400, name+" must be a RFC 3339 time")
+			}
+			*value = date
+		}
+	}
+	if param := c.QueryParam("limit"); param != "" {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			return query, echo.NewHTTPError(400, "limit must be between 1 and "+strconv.Itoa(maxSearchLimit))
+		}
+		query.limit = limit
+	}
+	return query, nil
+}
+
+// Reports whether a file matches every criteria. Size and extension filters exclude directories.
+func (query *searchQuery) matches(info fs.FileInfo) bool {
+	name := info.Name()
+	if query.glob != "" {
+		if matched, _ := filepath.Match(query.glob, name); !matched {
+			return false
+		}
+	}
+	if query.regex != nil && !query.regex.MatchString(name) {
+		return false
+	}
+	if query.exts != nil || query.minSize > 0 || query.maxSize > 0 {
+		if info.IsDir() || query.exts != nil && !query.exts[extOf(name)] {
+			return false
+		}
+		if info.Size() < query.minSize || query.maxSize > 0 && info.Size() > query.maxSize {
+			return false
+		}
+	}
+	if !query.after.IsZero() && info.ModTime().Before(query.after) {
+		return false
+	}
+	if !query.before.IsZero() && info.ModTime().After(query.before) {
+		return false
+	}
+	return true
+}
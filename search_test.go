@@ -0,0 +1,78 @@
+package gosses
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func search(t *testing.T, url string) ([]searchResult, searchSummary) {
+	resp, err := http.Get(url)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("search failed", resp.StatusCode)
+	}
+	var results []searchResult
+	var summary searchSummary
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var result searchResult
+		dieMaybe(t, json.Unmarshal(scanner.Bytes(), &result))
+		if result.Path == "" {
+			dieMaybe(t, json.Unmarshal(scanner.Bytes(), &summary))
+			continue
+		}
+		results = append(results, result)
+	}
+	dieMaybe(t, scanner.Err())
+	return results, summary
+}
+
+func TestSearch(t *testing.T) {
+	fmt.Println("========== testing search ============")
+	autoServe(t, Options{Root: "test-fixture", SkipHidden: true, Prefix: "/fancy-path/"}, func(url string) {
+		url += "/fancy-path/search?"
+		results, summary := search(t, url+"glob=*.js")
+		if len(results) != 3 || !summary.Done || summary.Count != 3 || summary.Truncated {
+			t.Fatal("glob search failed", results, summary)
+		}
+		if results[0].Path != "/compress/foo.js" || results[0].Href != "/fancy-path/compress/foo.js" || results[0].Type != "file" {
+			t.Fatal("wrong result", results[0])
+		}
+		if results, _ = search(t, url+"path=%2Fhols&regex=%5E(glasgow%7Cc)%5C."); len(results) != 2 || results[1].Path != "/hols/glasgow.jpg" {
+			t.Fatal("regex search failed", results)
+		}
+		// the path parameter may carry the prefix, which is only stripped once
+		results, _ = search(t, url+"path=%2Ffancy-path%2Ffancy-path")
+		if len(results) != 1 || results[0].Path != "/fancy-path/a" || results[0].Href != "/fancy-path/fancy-path/a" {
+			t.Fatal("prefix stripped twice", results)
+		}
+		if results, _ = search(t, url+"ext=jpg&minSize=500000&maxSize=600000"); len(results) != 1 {
+			t.Fatal("size search failed", results)
+		}
+		if results, _ = search(t, url+"glob=.testhidden"); len(results) != 0 {
+			t.Fatal("hidden file found")
+		}
+		future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		if results, _ = search(t, url+"after="+future); len(results) != 0 {
+			t.Fatal("mtime search failed", results)
+		}
+		if results, summary = search(t, url+"limit=2"); len(results) != 2 || !summary.Truncated {
+			t.Fatal("limit not applied", results, summary)
+		}
+		if resp, err := http.Get(url + "regex=("); err != nil || resp.StatusCode != 400 {
+			t.Fatal("invalid regex accepted")
+		}
+	})
+	opts := Options{Mounts: []Mount{{Name: "photos", Path: filepath.Join("test-fixture", "hols")}}}
+	autoServe(t, opts, func(url string) {
+		if results, _ := search(t, url+"/search?glob=glasgow*"); len(results) != 1 || results[0].Path != "/photos/glasgow.jpg" {
+			t.Fatal("search of mounts failed", results)
+		}
+	})
+}
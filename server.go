@@ -0,0 +1,672 @@
+package gosses
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/ziflex/lecho/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pageTemplate *template.Template
+
+//go:embed gosses-ui/ui.tmpl
+var pageHtml string
+
+//go:embed gosses-ui/script.js
+var scriptJs string
+
+//go:embed gosses-ui/style.css
+var styleCss string
+
+//go:embed gosses-ui/favicon.svg
+var faviconSvg []byte
+
+// Links to the neighbouring pages of a paginated listing, added below the entries as the UI has none.
+const pageNavHtml = `{{if or .PrevPage .NextPage}}<p class="page-nav">` +
+	`{{if .PrevPage}}<a href="{{.PrevPage}}">previous</a> {{end}}` +
+	`{{.FirstEntry}}-{{.LastEntry}} of {{.Total}}` +
+	`{{if .NextPage}} <a href="{{.NextPage}}">next</a>{{end}}</p>{{end}}`
+
+// Options configure a Server.
+type Options struct {
+	// Directory to share. Mutually exclusive with Mounts.
+	Root string
+	// Directories to share as named folders at the top level of the listing.
+	Mounts []Mount
+	// Url prefix at which gosses can be reached. Defaults to '/'.
+	Prefix string
+	// Follow symlinks. WARNING: symlinks will by nature allow escaping the shared path.
+	Symlinks bool
+	// Skip files prefixed with '.'.
+	SkipHidden bool
+	// Serve precompressed copies like 'foo.js.gz' in place of 'foo.js' to clients that accept their encoding.
+	Precompressed bool
+	// Hide precompressed copies from listings when Precompressed is enabled.
+	HidePrecompressed bool
+	// Compress listings and text files on the fly for clients that accept gzip, brotli or zstd.
+	Compress bool
+	// Answer errors of browsers with the 403.html, 404.html or 500.html page at the root of the share,
+	// or of the mount the request is for.
+	ErrorPages bool
+	// Directory to take error pages from when the share has none. Also enables error pages.
+	ErrorPagesDir string
+	// Directory for the full-text search index, which enables it. Must be outside of the shared directories.
+	IndexDir string
+	// How often the index is brought up to date with changes made outside of gosses.
+	// Defaults to 10 minutes. If negative, the index only follows changes made through gosses.
+	IndexInterval time.Duration
+	// Directory to cache image thumbnails in, which enables them. Must be outside of the shared directories.
+	ThumbnailDir string
+	// Path under Prefix at which the share is also served over WebDAV, like 'dav'. Disabled when empty.
+	WebDAV string
+	// Path under Prefix at which the share is also served over an S3-compatible API, like 's3'. Disabled when empty.
+	// Buckets are the folders at the root of the share.
+	S3 string
+	// Maps each S3 access key ID to its secret and user, which requests to the S3 API are signed with.
+	S3Keys map[string]S3Key
+	// Number of entries per page of a listing, 0 to list all of them. Requests can ask for other pages and sizes.
+	PageSize int
+	// Maps file extensions like '.opml' to the Content-Type to serve them with, overriding the built-in types.
+	MimeTypes map[string]string
+	// Disable upload, rename, move, etc for everyone, regardless of their profile.
+	ReadOnly bool
+	// Maps each username to its bcrypt password hash. Authentication is disabled when nil.
+	Users map[string][]byte
+	// Maps each username to the public keys it may log in with over SFTP.
+	AuthorizedKeys map[string][]ssh.PublicKey
+	// Maps each username to its permissions and home directory. Users without a profile get every permission.
+	Profiles map[string]Profile
+	// What to do when an upload targets an existing file, unless the request asks otherwise. Defaults to ConflictOverwrite.
+	Conflict ConflictPolicy
+	// Maximum size of a single uploaded file in bytes, 0 for no limit.
+	MaxUploadSize int64
+	// Maximum size of an RPC request body in bytes. Defaults to 1 MiB.
+	MaxRPCSize int64
+	// Uploads are rejected if they would leave less than this many bytes free on the target filesystem.
+	MinFreeSpace int64
+	// Directory for partial resumable uploads. Defaults to 'gosses-uploads' in the temporary directory.
+	StagingDir string
+	// Holds the shared files, which Root and Mounts are paths of. Defaults to the local filesystem.
+	Storage Storage
+	// Logger for requests and errors. Defaults to the global zerolog logger.
+	Logger *zerolog.Logger
+}
+
+// Server serves a directory with the gosses UI. It implements http.Handler.
+type Server struct {
+	opts Options
+	echo *echo.Echo
+	// Holds the shared files, Options.Storage or the local filesystem.
+	storage Storage
+	// The single mount backing the whole share when Options.Root is used.
+	root *Mount
+	// Listed at the top level when Options.Mounts is used.
+	mounts []Mount
+	// Credentials that already passed bcrypt, keyed by a digest of username and password.
+	// Saves a costly bcrypt comparison on every request, since browsers resend credentials with each one.
+	verifiedLogins sync.Map
+	// Resumable uploads currently being written to.
+	tusLocks map[string]bool
+	tusMu    sync.Mutex
+	// Serializes placing uploads, so two of them can't claim the same free name.
+	uploadMu sync.Mutex
+	// The full-text search index, nil if disabled.
+	index *textIndex
+	// Serves Options.WebDAV, nil if disabled.
+	webdav *webdav.Handler
+	// Limits how many thumbnails are generated at once, as decoding images takes a lot of memory.
+	thumbnailSlots chan struct{}
+	// Closed to stop background work like indexing, which is tracked by background.
+	stop       chan struct{}
+	background sync.WaitGroup
+}
+
+type pageRowData struct {
+	Name string
+	Href string
+	Size string
+	Ext  string
+}
+
+type pageData struct {
+	Title       string
+	ExtraPath   string
+	Ro          bool
+	RowsFiles   []pageRowData
+	RowsFolders []pageRowData
+	// Total counts the entries matching the filters, of which at most Limit are shown from Offset on.
+	Total  int
+	Offset int
+	Limit  int
+	// Query strings of the neighbouring pages, empty if there is none.
+	PrevPage string
+	NextPage string
+	// Positions of the first and last shown entries among Total, counting from 1.
+	FirstEntry int
+	LastEntry  int
+}
+
+type rpcCall struct {
+	Call string   `json:"call"`
+	Args []string `json:"args"`
+}
+
+// The permission required by each RPC call.
+var rpcPermissions = map[string]Permission{
+	"mkdirp": PermMkdir,
+	"mv":     PermMv,
+	"rm":     PermRm,
+}
+
+// The number of paths each RPC call takes.
+var rpcArgCounts = map[string]int{
+	"mkdirp": 1,
+	"mv":     2,
+	"rm":     1,
+}
+
+func init() {
+	pageHtml = strings.Replace(pageHtml, "css_will_be_here", styleCss, 1)
+	pageHtml = strings.Replace(pageHtml, "js_will_be_here", scriptJs, 1)
+	pageHtml = strings.Replace(pageHtml, "favicon_will_be_here", base64.StdEncoding.EncodeToString(faviconSvg), 2)
+	pageHtml = strings.Replace(pageHtml, "</table>", "</table>\n"+pageNavHtml, 1)
+	var err error
+	pageTemplate, err = template.New("").Parse(pageHtml)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+// New validates opts and creates a Server from them.
+func New(opts Options) (*Server, error) {
+	if opts.Storage == nil {
+		opts.Storage = LocalStorage{}
+	}
+	s := &Server{storage: opts.Storage, tusLocks: map[string]bool{}, stop: make(chan struct{})}
+	if err := s.setupMounts(opts); err != nil {
+		return nil, err
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "/"
+	} else if !strings.HasPrefix(opts.Prefix, "/") {
+		return nil, fmt.Errorf("prefix '%s' must start with '/'", opts.Prefix)
+	}
+	// ensure that prefix has single trailing slash, required by frontend
+	opts.Prefix = strings.TrimSuffix(opts.Prefix, "/") + "/"
+	if opts.Profiles != nil {
+		profiles := map[string]Profile{}
+		for username, profile := range opts.Profiles {
+			var err error
+			if profile, err = s.checkProfile(profile); err != nil {
+				return nil, fmt.Errorf("profile of user '%s': %w", username, err)
+			}
+			profiles[username] = profile
+		}
+		opts.Profiles = profiles
+	}
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictOverwrite
+	} else if _, err := ParseConflictPolicy(string(opts.Conflict)); err != nil {
+		return nil, err
+	}
+	if opts.MimeTypes != nil {
+		mimeTypes := map[string]string{}
+		for ext, contentType := range opts.MimeTypes {
+			mimeTypes["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = contentType
+		}
+		opts.MimeTypes = mimeTypes
+	}
+	if opts.WebDAV != "" {
+		if opts.WebDAV = strings.Trim(opts.WebDAV, "/"); opts.WebDAV == "" {
+			return nil, fmt.Errorf("webdav path must not be the root")
+		}
+	}
+	if opts.S3 != "" {
+		if opts.S3 = strings.Trim(opts.S3, "/"); opts.S3 == "" {
+			return nil, fmt.Errorf("s3 path must not be the root")
+		}
+		if len(opts.S3Keys) == 0 {
+			return nil, fmt.Errorf("s3 requires access keys")
+		}
+	}
+	if opts.MaxRPCSize <= 0 {
+		opts.MaxRPCSize = defaultMaxRPCSize
+	}
+	if opts.StagingDir == "" {
+		opts.StagingDir = filepath.Join(os.TempDir(), "gosses-uploads")
+	}
+	if opts.Logger == nil {
+		opts.Logger = &log.Logger
+	}
+	s.opts = opts
+	if opts.IndexDir != "" {
+		if s.opts.IndexInterval == 0 {
+			s.opts.IndexInterval = defaultIndexInterval
+		}
+		if err := s.checkOutsideMounts(opts.IndexDir, "index directory"); err != nil {
+			return nil, err
+		}
+		if err := s.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ThumbnailDir != "" {
+		if err := s.checkOutsideMounts(opts.ThumbnailDir, "thumbnail directory"); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(opts.ThumbnailDir, 0700); err != nil {
+			return nil, err
+		}
+		s.thumbnailSlots = make(chan struct{}, runtime.NumCPU())
+	}
+	if opts.WebDAV != "" {
+		s.webdav = s.newWebDAV()
+	}
+	// background work only starts once nothing can fail, as the caller couldn't stop it without a Server
+	s.background.Add(1)
+	go s.sweepTempFiles(time.Now())
+	if opts.IndexDir != "" {
+		s.background.Add(1)
+		go s.runIndexer()
+	}
+	if opts.ThumbnailDir != "" {
+		s.background.Add(1)
+		go s.runThumbnailSweeper()
+	}
+	s.echo = s.newEcho()
+	return s, nil
+}
+
+// Close stops background work and saves the full-text search index.
+func (s *Server) Close() error {
+	close(s.stop)
+	s.background.Wait()
+	if s.index == nil {
+		return nil
+	}
+	return s.saveIndex()
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.echo.ServeHTTP(w, r)
+}
+
+func (s *Server) newEcho() *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	logger := lecho.From(*s.opts.Logger)
+	e.Logger = logger
+	logging := lecho.Middleware(lecho.Config{Logger: logger})
+	e.Use(logging)
+	e.HTTPErrorHandler = s.handleError
+	if s.webdav != nil {
+		e.Pre(s.davRouter(logging))
+	}
+
+	// handleUnknown has to be defined before handleContent so if prefix is '/' handleContent can take precedence.
+	e.GET("*", s.handleUnknown)
+
+	group := e.Group(s.opts.Prefix)
+	group.POST("rpc", s.handleRPC, s.authChecker, s.readOnlyChecker)
+	group.POST("post", s.handleUpload, s.authChecker, s.readOnlyChecker, s.permissionChecker(PermUpload))
+	s.addTusRoutes(group)
+	group.GET("zip", s.handleArchive, s.authChecker, s.permissionChecker(PermRead))
+	group.GET("search", s.handleSearch, s.authChecker, s.permissionChecker(PermRead))
+	if s.index != nil {
+		group.GET("fulltext", s.handleFullText, s.authChecker, s.permissionChecker(PermRead))
+	}
+	if s.opts.ThumbnailDir != "" {
+		group.GET("thumbnail", s.handleThumbnail, s.authChecker, s.permissionChecker(PermRead))
+	}
+	if s.opts.S3 != "" {
+		s.addS3Routes(group)
+	}
+	group.GET("*", s.handleContent, s.authChecker, s.permissionChecker(PermRead), s.compressor)
+	return e
+}
+
+func (s *Server) handleUnknown(c echo.Context) error {
+	return c.Redirect(302, s.opts.Prefix)
+}
+
+func (s *Server) readOnlyChecker(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.opts.ReadOnly {
+			return errForbidden
+		} else {
+			return handlerFunc(c)
+		}
+	}
+}
+
+// Shortens byte count to human-readable alternative such as kilobytes or megabytes.
+func humanize(bytes int64) string {
+	b := float64(bytes)
+	u := 0
+	for {
+		if b < 1024 {
+			return strconv.FormatFloat(b, 'f', 1, 64) + [9]string{"B", "k", "M", "G", "T", "P", "E", "Z", "Y"}[u]
+		}
+		b = b / 1024
+		u++
+	}
+}
+
+// Handles content requests from the frontend.
+// If the file is a directory, it will be listed, otherwise it will be served directly.
+func (s *Server) handleContent(c echo.Context) error {
+	filePath, mount, err := s.resolvePath(c, c.Request().URL.Path)
+	if os.IsNotExist(err) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	if filePath == "" {
+		return s.handleListDir(c, filePath, mount)
+	}
+	stat, err := s.stat(filePath)
+	if os.IsNotExist(err) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	// error on hidden files but not current directory '.' or the directory of a mount
+	if s.opts.SkipHidden && strings.HasPrefix(stat.Name(), ".") && filePath != mount.Path {
+		return errNotFound
+	}
+	if !stat.IsDir() {
+		if s.opts.Precompressed {
+			if served, err := s.servePrecompressed(c, filePath); served || err != nil {
+				return err
+			}
+		}
+		return s.serveFile(c, filePath)
+	} else {
+		if err := s.handleListDir(c, filePath, mount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handles a directory list from the frontend, or from API clients asking for JSON.
+// An empty filePath lists the mounts at the virtual root.
+func (s *Server) handleListDir(c echo.Context, filePath string, mount *Mount) error {
+	rel := filepath.ToSlash(s.cleanPath(c.Request().URL.Path))
+	query, err := s.parseListQuery(c)
+	if err != nil {
+		return err
+	}
+	entries, total, err := s.readDir(filePath, query)
+	if err != nil {
+		return err
+	}
+	if wantsJSON(c) {
+		return c.JSON(200, s.newDirListing(rel, entries, total, query))
+	}
+	p := pageData{
+		// leading slash is required by frontend
+		Title:     "/",
+		ExtraPath: s.opts.Prefix,
+		// the frontend can only toggle all modifications at once
+		Ro: !s.writable(mount) || !s.hasPermission(c, PermUpload) && !s.hasPermission(c, PermMkdir) &&
+			!s.hasPermission(c, PermMv) && !s.hasPermission(c, PermRm),
+		Total:  total,
+		Offset: query.Offset,
+		Limit:  query.Limit,
+	}
+	if query.Limit > 0 {
+		p.FirstEntry, p.LastEntry = query.Offset+1, query.Offset+len(entries)
+		if query.Offset > 0 {
+			p.PrevPage = pageQuery(c, query.Offset-query.Limit)
+		}
+		if query.Offset+query.Limit < total {
+			p.NextPage = pageQuery(c, query.Offset+query.Limit)
+		}
+	}
+	if rel != "/" {
+		p.RowsFolders = append(p.RowsFolders, pageRowData{"../", "../", "", "folder"})
+		// trailing slash is required by frontend
+		p.Title = rel + "/"
+	}
+	for _, entry := range entries {
+		if entry.Type == "dir" {
+			p.RowsFolders = append(p.RowsFolders, pageRowData{
+				// trailing slash is required by frontend
+				entry.Name + "/",
+				entry.Name,
+				"",
+				"folder",
+			})
+		} else {
+			p.RowsFiles = append(p.RowsFiles, pageRowData{
+				entry.Name,
+				entry.Name,
+				humanize(entry.Size),
+				s.iconExt(entry.Name),
+			})
+		}
+	}
+	return s.renderPage(c, &p)
+}
+
+func (s *Server) renderPage(c echo.Context, p *pageData) error {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	return pageTemplate.Execute(c.Response().Writer, p)
+}
+
+// Handles a directory download from the frontend, as a ZIP archive or a tarball depending on the format query parameter.
+func (s *Server) handleArchive(c echo.Context) error {
+	zipPath := c.QueryParam("zipPath")
+	zipName := c.QueryParam("zipName")
+	formatName := c.QueryParam("format")
+	if formatName == "" {
+		formatName = "zip"
+	}
+	format, ok := archiveFormats[formatName]
+	if !ok {
+		return echo.NewHTTPError(400, fmt.Sprintf("unknown archive format '%s'", formatName))
+	}
+	zipFullPath, mount, err := s.resolvePath(c, zipPath)
+	if os.IsNotExist(err) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	if zipFullPath != "" {
+		if _, err := s.stat(zipFullPath); os.IsNotExist(err) {
+			return errNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+	header := c.Response().Header()
+	header.Set("Content-Disposition", "attachment; filename=\""+zipName+format.ext+"\"")
+	header.Set(echo.HeaderContentType, format.contentType)
+	archive, err := format.create(s.storage, c.Response().Writer)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if zipFullPath == "" {
+		// the virtual root, archive every mount under its name
+		for _, mount := range s.mounts {
+			if s.opts.SkipHidden && strings.HasPrefix(mount.Name, ".") {
+				continue
+			}
+			if err := s.archiveDir(archive, mount.Path, mount.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	baseName := filepath.Base(zipFullPath)
+	if mount != s.root && zipFullPath == mount.Path {
+		// the directory may be shared under a different name
+		baseName = mount.Name
+	}
+	return s.archiveDir(archive, zipFullPath, baseName)
+}
+
+// Handles an RPC call from the frontend.
+func (s *Server) handleRPC(c echo.Context) error {
+	bodyBytes, err := s.readRPCBody(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	var rpc rpcCall
+	if err := json.Unmarshal(bodyBytes, &rpc); err != nil {
+		return err
+	}
+	perm, ok := rpcPermissions[rpc.Call]
+	if !ok {
+		return errors.New("unknown rpc call")
+	}
+	if !s.hasPermission(c, perm) {
+		return errForbidden
+	}
+	if len(rpc.Args) != rpcArgCounts[rpc.Call] {
+		return echo.NewHTTPError(400, fmt.Sprintf("%s takes %d arguments", rpc.Call, rpcArgCounts[rpc.Call]))
+	}
+	var paths []string
+	for _, arg := range rpc.Args {
+		path, mount, err := s.resolvePath(c, arg)
+		if err != nil {
+			return err
+		}
+		// also covers the source of mv, which gets removed
+		if !s.writable(mount) || path == mount.Path {
+			return errForbidden
+		}
+		paths = append(paths, path)
+	}
+	switch rpc.Call {
+	case "mkdirp":
+		err = s.storage.MkdirAll(paths[0], os.ModePerm)
+	case "mv":
+		if err = s.storage.Rename(paths[0], paths[1]); err == nil {
+			s.indexMoved(paths[0], paths[1])
+			s.pruneThumbnailsOf(paths[0])
+		}
+	case "rm":
+		if err = s.storage.RemoveAll(paths[0]); err == nil {
+			s.indexRemoved(paths[0])
+			s.pruneThumbnailsOf(paths[0])
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return c.String(200, "ok")
+}
+
+func (s *Server) stat(name string) (os.FileInfo, error) {
+	return s.statIn(s.storage, name)
+}
+
+// Like stat, for a file in storage.
+func (s *Server) statIn(storage Storage, name string) (os.FileInfo, error) {
+	if s.opts.Symlinks {
+		return storage.Stat(name)
+	} else {
+		return storage.Lstat(name)
+	}
+}
+
+func (s *Server) walk(path string, walkFn filepath.WalkFunc) error {
+	return s.storage.Walk(path, s.opts.Symlinks, walkFn)
+}
+
+// Serves the content of a shared file, like http.ServeFile.
+func (s *Server) serveFile(c echo.Context, filePath string) error {
+	file, err := s.storage.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	s.setCustomContentType(c, filePath)
+	http.ServeContent(c.Response().Writer, c.Request(), stat.Name(), stat.ModTime(), file)
+	return nil
+}
+
+// Cleans a request path and strips away the prefix.
+// The result is rooted at '/' and can't traverse above it.
+func (s *Server) cleanPath(unsafePath string) string {
+	unsafePath, err := filepath.Rel(s.opts.Prefix, filepath.Clean("//"+unsafePath))
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Clean("//" + unsafePath)
+}
+
+// Resolves file paths relative to the root of the current user, stripping away the prefix.
+// Returns the mount containing the file, or an empty path and nil mount for the virtual root listing all mounts.
+// Accounts for symlinks, if enabled.
+// Prevents any directory traversal attacks.
+func (s *Server) resolvePath(c echo.Context, unsafePath string) (string, *Mount, error) {
+	return s.resolveCleanPath(c, s.cleanPath(unsafePath))
+}
+
+// Resolves a path relative to the root of the current user like resolvePath, for paths that were already cleaned
+// with cleanPath and must not have the prefix stripped again.
+func (s *Server) resolveCleanPath(c echo.Context, cleanPath string) (string, *Mount, error) {
+	virtualPath := filepath.Join(s.currentProfile(c).Home, cleanPath)
+	mount, mountPath, err := s.findMount(virtualPath)
+	if err != nil || mount == nil {
+		return "", nil, err
+	}
+	newPath := filepath.Join(mount.Path, mountPath)
+	if s.opts.Symlinks {
+		evalNewPath, err := s.storage.EvalSymlinks(newPath)
+		if err == nil && evalNewPath != "" {
+			newPath = evalNewPath
+		}
+	}
+	return newPath, mount, nil
+}
+
+// Resolves a path relative to the root of the current user like resolvePath, but without the URL prefix,
+// for the WebDAV and SFTP servers. Hidden files don't exist when they are skipped.
+func (s *Server) resolveSharePath(c echo.Context, sharePath string) (string, *Mount, error) {
+	sharePath = path.Clean("/" + sharePath)
+	if s.opts.SkipHidden && strings.Contains(sharePath, "/.") {
+		return "", nil, &fs.PathError{Op: "resolve", Path: sharePath, Err: fs.ErrNotExist}
+	}
+	return s.resolveCleanPath(c, filepath.FromSlash(sharePath))
+}
+
+// Resolves a path to modify with perm like resolveSharePath, for the WebDAV and SFTP servers.
+// It must be inside a writable mount and not be the mount itself.
+func (s *Server) resolveWritableSharePath(c echo.Context, sharePath string, perm Permission) (string, error) {
+	filePath, mount, err := s.resolveSharePath(c, sharePath)
+	if err != nil {
+		return "", err
+	}
+	if !s.hasPermission(c, perm) || !s.writable(mount) || filePath == mount.Path {
+		return "", &fs.PathError{Op: "write", Path: sharePath, Err: fs.ErrPermission}
+	}
+	return filePath, nil
+}
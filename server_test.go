@@ -1,18 +1,17 @@
-package main
+package gosses
 
 import (
 	"bytes"
-	"context"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
-	"time"
 )
 
 func dieMaybe(t *testing.T, err error) {
@@ -153,6 +152,13 @@ func doTestRegular(t *testing.T, url string, testExtra bool) {
 		t.Fatal("mkdir rpc folder not created")
 	}
 
+	// ~~~~~~~~~~~~~~~~~
+	fmt.Println("\r\n~~~~~~~~~~ test rpc with missing arguments")
+	body0 = postJSON(t, url+"rpc", `{"call":"mv","args":["/AAA"]}`)
+	if body0 != `mv takes 2 arguments` {
+		t.Fatal("rpc with missing arguments passed", body0)
+	}
+
 	// ~~~~~~~~~~~~~~~~~
 	fmt.Println("\r\n~~~~~~~~~~ test invalid mkdir rpc")
 	body0 = postJSON(t, url+"rpc", `{"call":"mkdirp","args":["../BBB"]}`)
@@ -350,29 +356,14 @@ func doTestReadonly(t *testing.T, url string) {
 	fmt.Printf("\r\n=========\r\n")
 }
 
-func TestMain(m *testing.M) {
-	*host = "127.0.0.1"
-	*port = 8001
-	rootPath = "test-fixture"
-	os.Exit(m.Run())
-}
-
 func TestNormal(t *testing.T) {
-	*readOnly = false
-	*symlinks = false
-	*skipHidden = true
-	*prefixPath = "/"
 	fmt.Println("========== testing normal path ============")
-	autoServe(t, func() {
-		doTestRegular(t, "http://127.0.0.1:8001/", false)
+	autoServe(t, Options{Root: "test-fixture", SkipHidden: true}, func(url string) {
+		doTestRegular(t, url+"/", false)
 	})
 }
 
 func TestExtra(t *testing.T) {
-	*readOnly = false
-	*symlinks = true
-	*skipHidden = false
-	*prefixPath = "/fancy-path/"
 	// TODO: Symlinking will fail on Windows unless run as Administrator.
 	symlinkPath := filepath.Join("test-fixture", "symlink-test")
 	if err := os.Symlink(filepath.Join(".", "subdir"), symlinkPath); err != nil {
@@ -380,39 +371,24 @@ func TestExtra(t *testing.T) {
 	}
 	defer os.Remove(symlinkPath)
 	fmt.Println("========== testing extras options ============")
-	autoServe(t, func() {
-		doTestRegular(t, "http://127.0.0.1:8001/fancy-path/", true)
+	autoServe(t, Options{Root: "test-fixture", Symlinks: true, Prefix: "/fancy-path/"}, func(url string) {
+		doTestRegular(t, url+"/fancy-path/", true)
 	})
 }
 
 func TestRo(t *testing.T) {
-	*readOnly = true
-	*symlinks = false
-	*skipHidden = true
-	*prefixPath = "/"
-
 	fmt.Println("========== testing read only ============")
-	autoServe(t, func() {
-		doTestReadonly(t, "http://127.0.0.1:8001/")
+	autoServe(t, Options{Root: "test-fixture", SkipHidden: true, ReadOnly: true}, func(url string) {
+		doTestReadonly(t, url+"/")
 	})
 }
 
-func autoServe(t *testing.T, action func()) {
-	e := serve(false)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	for ctx.Err() == nil {
-		// wait for server to start responding
-		_, err := http.Get(fmt.Sprintf("http://%s:%d", *host, *port))
-		if err == nil {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	cancel()
-	if ctx.Err() == context.DeadlineExceeded {
-		t.Fatal(ctx.Err())
-	} else {
-		defer e.Shutdown(context.Background())
-		action()
-	}
+func autoServe(t *testing.T, opts Options, action func(url string)) {
+	server, err := New(opts)
+	dieMaybe(t, err)
+	// stops the background work of the server
+	t.Cleanup(func() { server.Close() })
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	action(ts.URL)
 }
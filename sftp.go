@@ -0,0 +1,395 @@
+package gosses
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errSFTPLogin = errors.New("invalid credentials")
+
+// LoadAuthorizedKeys loads an OpenSSH authorized_keys file for Options.AuthorizedKeys.
+// The comment of each key is the username it logs in as, e.g. 'ssh-ed25519 AAAA... alice'.
+func LoadAuthorizedKeys(path string) (map[string][]ssh.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := map[string][]ssh.PublicKey{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, username, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if username == "" {
+			return nil, fmt.Errorf("%s:%d: expected the username as the comment of the key", path, lineNum)
+		}
+		result[username] = append(result[username], key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LoadHostKey loads the private host key of the SFTP server, generating an ed25519 key at path if there is none yet.
+func LoadHostKey(path string) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, keyBytes, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// ServeSFTP serves the share over SFTP to the connections accepted from listener, until it is closed.
+// Users log in with their password from Options.Users or a key from Options.AuthorizedKeys,
+// and get the same permissions, home directory and view of the files as in the web UI.
+func (s *Server) ServeSFTP(listener net.Listener, hostKey ssh.Signer) error {
+	config := &ssh.ServerConfig{ServerVersion: "SSH-2.0-gosses"}
+	if s.opts.Users != nil {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.checkPassword(conn.User(), string(password)) {
+				return nil, nil
+			}
+			s.opts.Logger.Warn().Str("user", conn.User()).Str("remote_ip", conn.RemoteAddr().String()).Msg("failed login")
+			return nil, errSFTPLogin
+		}
+	}
+	if s.opts.AuthorizedKeys != nil {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range s.opts.AuthorizedKeys[conn.User()] {
+				if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			// clients try each of their keys, so a mismatch isn't worth a warning
+			return nil, errSFTPLogin
+		}
+	}
+	if config.PasswordCallback == nil && config.PublicKeyCallback == nil {
+		return errors.New("sftp requires users or authorized keys")
+	}
+	config.AddHostKey(hostKey)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.serveSSHConn(conn, config)
+	}
+}
+
+func (s *Server) serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		s.opts.Logger.Debug().Err(err).Str("remote_ip", conn.RemoteAddr().String()).Msg("ssh handshake failed")
+		return
+	}
+	defer sshConn.Close()
+	s.opts.Logger.Info().Str("user", sshConn.User()).Str("remote_ip", conn.RemoteAddr().String()).Msg("sftp login")
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSFTPSession(sshConn.User(), channel, requests)
+	}
+}
+
+// Runs the SFTP subsystem on a session channel. There is no shell and no commands.
+func (s *Server) serveSFTPSession(username string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		// the payload is the name of the subsystem as an SSH string
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		c := s.echo.NewContext(nil, nil)
+		c.Set("user", username)
+		fsys := sftpFS{s, c}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: fsys, FilePut: fsys, FileCmd: fsys, FileList: fsys})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			s.opts.Logger.Debug().Err(err).Str("user", username).Msg("sftp session failed")
+		}
+		server.Close()
+		return
+	}
+}
+
+// Serves the share to a user logged in over SFTP, going through the same path resolution, permissions,
+// hidden file skipping and symlink policy as the web UI. Implements the handlers of sftp.RequestServer.
+type sftpFS struct {
+	s *Server
+	// Stands in for an HTTP request of the user, to resolve paths and check permissions.
+	c echo.Context
+}
+
+func (fsys sftpFS) resolve(name string) (string, *Mount, error) {
+	if !fsys.s.hasPermission(fsys.c, PermRead) {
+		return "", nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrPermission}
+	}
+	return fsys.s.resolveSharePath(fsys.c, name)
+}
+
+func (fsys sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	filePath, mount, err := fsys.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.s.statShared(filePath, mount)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: r.Filepath, Err: errIsDir}
+	}
+	return fsys.s.storage.Open(filePath)
+}
+
+func (fsys sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	filePath, err := fsys.s.resolveWritableSharePath(fsys.c, r.Filepath, PermUpload)
+	if err != nil {
+		return nil, err
+	}
+	flags := r.Pflags()
+	info, err := fsys.s.stat(filePath)
+	if err == nil && info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: r.Filepath, Err: errIsDir}
+	} else if err == nil && flags.Creat && flags.Excl {
+		return nil, &fs.PathError{Op: "open", Path: r.Filepath, Err: fs.ErrExist}
+	} else if err != nil && !flags.Creat {
+		return nil, err
+	}
+	if err := fsys.s.checkUploadLimits(filepath.Dir(filePath), -1); err != nil {
+		return nil, err
+	}
+	return fsys.s.newSFTPUpload(filePath, info != nil && !flags.Trunc)
+}
+
+func (fsys sftpFS) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Mkdir":
+		filePath, err := fsys.s.resolveWritableSharePath(fsys.c, r.Filepath, PermMkdir)
+		if err != nil {
+			return err
+		}
+		return fsys.s.storage.Mkdir(filePath, os.ModePerm)
+	case "Rename":
+		return fsys.rename(r, false)
+	case "Remove", "Rmdir":
+		filePath, err := fsys.s.resolveWritableSharePath(fsys.c, r.Filepath, PermRm)
+		if err != nil {
+			return err
+		}
+		info, err := fsys.s.storage.Lstat(filePath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != (r.Method == "Rmdir") {
+			return &fs.PathError{Op: strings.ToLower(r.Method), Path: r.Filepath, Err: fs.ErrInvalid}
+		}
+		// unlike rm, directories have to be empty
+		if err := fsys.s.storage.Remove(filePath); err != nil {
+			return err
+		}
+		fsys.s.indexRemoved(filePath)
+		fsys.s.pruneThumbnailsOf(filePath)
+		return nil
+	case "Setstat":
+		filePath, err := fsys.s.resolveWritableSharePath(fsys.c, r.Filepath, PermUpload)
+		if err != nil {
+			return err
+		}
+		// only times are kept, as clients set them after uploading, other attributes are left as they are
+		if attrs := r.Attributes(); r.AttrFlags().Acmodtime {
+			return fsys.s.storage.Chtimes(filePath, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+		}
+		return nil
+	}
+	// links could escape the share
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename renames like Rename, but replaces an existing target.
+func (fsys sftpFS) PosixRename(r *sftp.Request) error {
+	return fsys.rename(r, true)
+}
+
+func (fsys sftpFS) rename(r *sftp.Request, replace bool) error {
+	oldPath, err := fsys.s.resolveWritableSharePath(fsys.c, r.Filepath, PermMv)
+	if err != nil {
+		return err
+	}
+	newPath, err := fsys.s.resolveWritableSharePath(fsys.c, r.Target, PermMv)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.s.storage.Lstat(newPath); err == nil && !replace {
+		return &fs.PathError{Op: "rename", Path: r.Target, Err: fs.ErrExist}
+	}
+	if err := fsys.s.storage.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	fsys.s.indexMoved(oldPath, newPath)
+	fsys.s.pruneThumbnailsOf(oldPath)
+	return nil
+}
+
+func (fsys sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	filePath, mount, err := fsys.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.s.statShared(filePath, mount)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		if !info.IsDir() {
+			return nil, &fs.PathError{Op: "readdir", Path: r.Filepath, Err: fs.ErrInvalid}
+		}
+		entries, err := fsys.s.listShared(filePath)
+		return sftpLister(entries), err
+	case "Stat":
+		return sftpLister{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type sftpLister []fs.FileInfo
+
+func (l sftpLister) ListAt(entries []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(entries, l[offset:])
+	if n < len(entries) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// A file being uploaded over SFTP. It's written atomically like uploads from the web UI,
+// and only replaces the target once the client closes it.
+type sftpUpload struct {
+	s    *Server
+	path string
+	file File
+	// Receives the outcome of the transfer once the client is done, then gives back the outcome of the upload.
+	transfer chan error
+	done     chan error
+	mu       sync.Mutex
+	err      error
+}
+
+// Starts an upload to filePath, which keeps its current content until overwritten if keep is set.
+func (s *Server) newSFTPUpload(filePath string, keep bool) (*sftpUpload, error) {
+	upload := &sftpUpload{s: s, path: filePath, transfer: make(chan error, 1), done: make(chan error, 1)}
+	ready := make(chan File)
+	go func() {
+		upload.done <- writeAtomic(s.storage, filePath, func(file File) error {
+			if keep {
+				src, err := s.storage.Open(filePath)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(file, src)
+				src.Close()
+				if err != nil {
+					return err
+				}
+			}
+			ready <- file
+			return <-upload.transfer
+		}, nil)
+	}()
+	select {
+	case upload.file = <-ready:
+		return upload, nil
+	case err := <-upload.done:
+		return nil, err
+	}
+}
+
+func (u *sftpUpload) WriteAt(p []byte, offset int64) (int, error) {
+	if u.s.opts.MaxUploadSize > 0 && offset+int64(len(p)) > u.s.opts.MaxUploadSize {
+		err := u.s.errUploadTooLarge()
+		u.TransferError(err)
+		return 0, err
+	}
+	n, err := u.file.WriteAt(p, offset)
+	if err != nil {
+		u.TransferError(err)
+	}
+	return n, err
+}
+
+// TransferError is called when the transfer failed, so the upload leaves the target as it was.
+func (u *sftpUpload) TransferError(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *sftpUpload) Close() error {
+	u.mu.Lock()
+	u.transfer <- u.err
+	u.mu.Unlock()
+	err := <-u.done
+	if err == nil {
+		u.s.indexChanged(u.path)
+	}
+	return err
+}
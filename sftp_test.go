@@ -0,0 +1,159 @@
+package gosses
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sftpClient(t *testing.T, addr string, user string, auth ssh.AuthMethod, hostKey ssh.PublicKey) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return sftp.NewClient(conn)
+}
+
+func TestSFTP(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, "docs"), 0755))
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, ".hidden"), 0755))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "b.txt"), []byte("hello"), 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "docs", "c.txt"), []byte("world"), 0644))
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dieMaybe(t, err)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	dieMaybe(t, err)
+	clientKey, err := ssh.NewSignerFromKey(privateKey)
+	dieMaybe(t, err)
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	dieMaybe(t, err)
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	dieMaybe(t, os.WriteFile(keysFile, []byte("# readers\n"+string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(sshPublicKey)))+" bob\n"), 0644))
+
+	fmt.Println("========== testing sftp keys ============")
+	keys, err := LoadAuthorizedKeys(keysFile)
+	dieMaybe(t, err)
+	if len(keys["bob"]) != 1 {
+		t.Fatal("wrong authorized keys", keys)
+	}
+	hostKeyPath := filepath.Join(t.TempDir(), "keys", "host_key")
+	hostKey, err := LoadHostKey(hostKeyPath)
+	dieMaybe(t, err)
+	reloaded, err := LoadHostKey(hostKeyPath)
+	dieMaybe(t, err)
+	if !bytes.Equal(hostKey.PublicKey().Marshal(), reloaded.PublicKey().Marshal()) {
+		t.Fatal("host key not kept")
+	}
+
+	opts := Options{
+		Root:           scratch,
+		SkipHidden:     true,
+		Users:          map[string][]byte{"alice": hash},
+		AuthorizedKeys: keys,
+		Profiles:       map[string]Profile{"bob": {Perms: PermRead, Home: "docs"}},
+	}
+	server, err := New(opts)
+	dieMaybe(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	dieMaybe(t, err)
+	defer listener.Close()
+	go server.ServeSFTP(listener, hostKey)
+	addr := listener.Addr().String()
+
+	if _, err := sftpClient(t, addr, "alice", ssh.Password("wrong"), hostKey.PublicKey()); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	alice, err := sftpClient(t, addr, "alice", ssh.Password("secret"), hostKey.PublicKey())
+	dieMaybe(t, err)
+
+	fmt.Println("========== testing sftp reads ============")
+	entries, err := alice.ReadDir("/")
+	dieMaybe(t, err)
+	if len(entries) != 2 || entries[0].Name() != "b.txt" && entries[1].Name() != "b.txt" {
+		t.Fatal("wrong listing", entries)
+	}
+	file, err := alice.Open("/docs/../b.txt")
+	dieMaybe(t, err)
+	content, err := ioutil.ReadAll(file)
+	dieMaybe(t, err)
+	file.Close()
+	if string(content) != "hello" {
+		t.Fatal("wrong content", string(content))
+	}
+	if _, err := alice.Stat("/.hidden"); err == nil {
+		t.Fatal("hidden directory found")
+	}
+	if _, err := alice.Stat("/../../etc/passwd"); err == nil {
+		t.Fatal("escaped the share")
+	}
+
+	fmt.Println("========== testing sftp changes ============")
+	file, err = alice.Create("/new.txt")
+	dieMaybe(t, err)
+	_, err = file.Write([]byte("some content"))
+	dieMaybe(t, err)
+	if _, err := os.Stat(filepath.Join(scratch, "new.txt")); !os.IsNotExist(err) {
+		t.Fatal("upload visible before it's complete")
+	}
+	dieMaybe(t, file.Close())
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dieMaybe(t, alice.Chtimes("/new.txt", mtime, mtime))
+	dieMaybe(t, alice.Mkdir("/dir"))
+	if err := alice.Rename("/new.txt", "/b.txt"); err == nil {
+		t.Fatal("rename replaced a file")
+	}
+	dieMaybe(t, alice.Rename("/new.txt", "/dir/moved.txt"))
+	if info, err := os.Stat(filepath.Join(scratch, "dir", "moved.txt")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatal("upload not moved", err)
+	}
+	if err := alice.RemoveDirectory("/dir"); err == nil {
+		t.Fatal("non-empty directory removed")
+	}
+	dieMaybe(t, alice.Remove("/dir/moved.txt"))
+	dieMaybe(t, alice.RemoveDirectory("/dir"))
+	if err := alice.Symlink("/etc", "/etc"); err == nil {
+		t.Fatal("symlink created")
+	}
+
+	fmt.Println("========== testing sftp profiles ============")
+	bob, err := sftpClient(t, addr, "bob", ssh.PublicKeys(clientKey), hostKey.PublicKey())
+	dieMaybe(t, err)
+	if entries, err = bob.ReadDir("/"); err != nil || len(entries) != 1 || entries[0].Name() != "c.txt" {
+		t.Fatal("wrong home", entries, err)
+	}
+	if _, err := bob.Create("/d.txt"); err == nil {
+		t.Fatal("upload without permission")
+	}
+	if err := bob.Remove("/c.txt"); err == nil {
+		t.Fatal("rm without permission")
+	}
+
+	fmt.Println("========== testing sftp-only logins ============")
+	opts.Users = nil
+	opts.WebDAV = "dav"
+	autoServe(t, opts, func(url string) {
+		if resp, err := http.Get(url + "/b.txt"); err != nil || resp.StatusCode != 401 {
+			t.Fatal("anonymous http access with profiles", resp, err)
+		}
+		if code, _ := dav(t, "PUT", url+"/dav/d.txt", nil, "content"); code != 401 {
+			t.Fatal("anonymous webdav access with profiles", code)
+		}
+	})
+}
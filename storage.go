@@ -0,0 +1,156 @@
+package gosses
+
+import (
+	"errors"
+	"github.com/facebookgo/symwalk"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+)
+
+// Storage holds the shared files. Every operation on them goes through it, so a share can live somewhere else than
+// on the local filesystem. Private directories of the server like the staging directory stay on the local filesystem.
+// Paths are absolute and use the separator of the local filesystem, like the ones of Mount.
+type Storage interface {
+	// Stat returns information about a file, following symlinks.
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat returns information about a file without following symlinks.
+	Lstat(name string) (fs.FileInfo, error)
+	// EvalSymlinks returns the path of a file after following all symlinks in it.
+	EvalSymlinks(name string) (string, error)
+	// Readlink returns the target of a symlink.
+	Readlink(name string) (string, error)
+	// ReadDir returns the entries of a directory sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Walk walks the tree at root like filepath.Walk, following symlinks to directories if followSymlinks is set.
+	Walk(root string, followSymlinks bool, walkFn filepath.WalkFunc) error
+	// Open opens a file for reading.
+	Open(name string) (File, error)
+	// CreateTemp creates a new file for reading and writing in dir, named after pattern like os.CreateTemp.
+	CreateTemp(dir string, pattern string) (File, error)
+	// Mkdir creates a directory, failing if its parent doesn't exist.
+	Mkdir(name string, perm fs.FileMode) error
+	// MkdirAll creates a directory along with any missing parent.
+	MkdirAll(name string, perm fs.FileMode) error
+	// Rename moves a file or directory, replacing any file at newName.
+	Rename(oldName string, newName string) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// RemoveAll removes a file or directory with everything in it, succeeding if it doesn't exist.
+	RemoveAll(name string) error
+	// Chtimes changes the access and modification times of a file.
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+// File is a file opened from a Storage.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Chmod(mode fs.FileMode) error
+	Sync() error
+}
+
+// FreeSpacer is implemented by a Storage that can tell how much space is left in a directory.
+// Options.MinFreeSpace isn't enforced on others.
+type FreeSpacer interface {
+	FreeSpace(dir string) (int64, error)
+}
+
+// LocalRenamer is implemented by a Storage that can move a file from the local filesystem into itself.
+// Finished resumable uploads are moved from the staging directory with it, before falling back to copying them.
+type LocalRenamer interface {
+	// RenameFrom moves the local file at localPath to name, replacing any file there.
+	RenameFrom(localPath string, name string) error
+}
+
+// LocalStorage is the Storage of the local filesystem, and the default one.
+type LocalStorage struct{}
+
+func (LocalStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalStorage) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (LocalStorage) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+func (LocalStorage) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (LocalStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (LocalStorage) Walk(root string, followSymlinks bool, walkFn filepath.WalkFunc) error {
+	if followSymlinks {
+		return symwalk.Walk(root, walkFn)
+	}
+	return filepath.Walk(root, walkFn)
+}
+
+func (LocalStorage) Open(name string) (File, error) {
+	// a nil *os.File must not become a non-nil File
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (LocalStorage) CreateTemp(dir string, pattern string) (File, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (LocalStorage) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (LocalStorage) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (LocalStorage) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (LocalStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalStorage) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (LocalStorage) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (LocalStorage) FreeSpace(dir string) (int64, error) {
+	return diskFree(dir)
+}
+
+func (LocalStorage) RenameFrom(localPath string, name string) error {
+	return os.Rename(localPath, name)
+}
@@ -0,0 +1,392 @@
+package gosses
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Size of thumbnails unless the request asks for another one of thumbnailSizes.
+	defaultThumbnailSize = 256
+	// Images with more pixels than this aren't thumbnailed, as decoding them would take too much memory.
+	maxThumbnailPixels = 50_000_000
+	// How often thumbnails of images that were deleted, moved or changed are removed from the cache.
+	thumbnailSweepInterval = time.Hour
+	// Name of the file recording which image the thumbnails in a cache directory are for.
+	thumbnailSourceFile = "source"
+	thumbnailQuality    = 85
+)
+
+// Sides of the squares thumbnails can be requested to fit in, in pixels.
+var thumbnailSizes = map[int]bool{64: true, 128: true, 256: true, 512: true, 1024: true}
+
+// Content-Type of thumbnails by extension.
+var thumbnailTypes = map[string]string{".jpg": "image/jpeg", ".png": "image/png"}
+
+var errUnsupportedImage = echo.NewHTTPError(415, "not a supported image")
+
+// Handles a request for a thumbnail of the image in the path parameter, fitting in a square of the size parameter.
+// Photos get a JPEG thumbnail, and PNG and GIF images a PNG one to keep their transparency.
+func (s *Server) handleThumbnail(c echo.Context) error {
+	size := defaultThumbnailSize
+	if param := c.QueryParam("size"); param != "" {
+		var err error
+		if size, err = strconv.Atoi(param); err != nil || !thumbnailSizes[size] {
+			return echo.NewHTTPError(400, "size must be 64, 128, 256, 512 or 1024")
+		}
+	}
+	filePath, _, err := s.resolvePath(c, c.QueryParam("path"))
+	if os.IsNotExist(err) || err == nil && filePath == "" {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	info, err := s.stat(filePath)
+	if os.IsNotExist(err) {
+		return errNotFound
+	} else if err != nil {
+		return err
+	}
+	if s.opts.SkipHidden && strings.HasPrefix(info.Name(), ".") {
+		return errNotFound
+	}
+	if !info.Mode().IsRegular() {
+		return errUnsupportedImage
+	}
+	thumbnailPath, contentType, err := s.thumbnail(filePath, info, size)
+	if err != nil {
+		return err
+	}
+	// an image that is its own thumbnail is in the share, the others are cached on the local filesystem
+	storage := Storage(LocalStorage{})
+	if thumbnailPath == filePath {
+		storage = s.storage
+	}
+	file, err := storage.Open(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	http.ServeContent(c.Response(), c.Request(), "", info.ModTime(), file)
+	return nil
+}
+
+// Returns the path and Content-Type of the thumbnail of an image, generating it if it isn't cached yet.
+// Images that already fit and need no rotation are their own thumbnail.
+func (s *Server) thumbnail(filePath string, info os.FileInfo, size int) (string, string, error) {
+	cacheDir := s.thumbnailCacheDir(filePath)
+	name := fmt.Sprintf("%s-%d", thumbnailVersion(info), size)
+	for ext, contentType := range thumbnailTypes {
+		if _, err := os.Stat(filepath.Join(cacheDir, name+ext)); err == nil {
+			return filepath.Join(cacheDir, name+ext), contentType, nil
+		}
+	}
+	s.thumbnailSlots <- struct{}{}
+	defer func() { <-s.thumbnailSlots }()
+	file, err := s.storage.Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	config, format, err := image.DecodeConfig(bufio.NewReader(file))
+	if err != nil {
+		return "", "", errUnsupportedImage
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return "", "", echo.NewHTTPError(413, "image is too large")
+	}
+	orientation := exifOrientation(file, format)
+	if config.Width <= size && config.Height <= size && orientation == 1 {
+		return filePath, "image/" + format, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	img, _, err := image.Decode(bufio.NewReader(file))
+	if err != nil {
+		return "", "", errUnsupportedImage
+	}
+	thumbnail := orient(scaleDown(img, size), orientation)
+	ext := ".jpg"
+	if format == "png" || format == "gif" {
+		ext = ".png"
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return "", "", err
+	}
+	err = writeAtomic(LocalStorage{}, filepath.Join(cacheDir, thumbnailSourceFile), func(file File) error {
+		_, err := io.WriteString(file, filePath)
+		return err
+	}, nil)
+	if err != nil {
+		return "", "", err
+	}
+	thumbnailPath := filepath.Join(cacheDir, name+ext)
+	err = writeAtomic(LocalStorage{}, thumbnailPath, func(file File) error {
+		if ext == ".png" {
+			return png.Encode(file, thumbnail)
+		}
+		return jpeg.Encode(file, thumbnail, &jpeg.Options{Quality: thumbnailQuality})
+	}, nil)
+	if err != nil {
+		return "", "", err
+	}
+	// thumbnails of previous versions of the image are of no use anymore
+	s.pruneThumbnails(cacheDir)
+	return thumbnailPath, thumbnailTypes[ext], nil
+}
+
+// Returns the directory caching the thumbnails of an image.
+func (s *Server) thumbnailCacheDir(filePath string) string {
+	digest := sha256.Sum256([]byte(filePath))
+	return filepath.Join(s.opts.ThumbnailDir, hex.EncodeToString(digest[:]))
+}
+
+// Identifies a version of an image, prefixing the names of its thumbnails.
+func thumbnailVersion(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// Removes cached thumbnails of images that were deleted, moved or changed,
+// every thumbnailSweepInterval until the server is closed.
+func (s *Server) runThumbnailSweeper() {
+	defer s.background.Done()
+	ticker := time.NewTicker(thumbnailSweepInterval)
+	defer ticker.Stop()
+	for {
+		s.sweepThumbnails()
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Prunes every cache directory of Options.ThumbnailDir.
+func (s *Server) sweepThumbnails() {
+	entries, err := os.ReadDir(s.opts.ThumbnailDir)
+	if err != nil {
+		s.opts.Logger.Warn().Err(err).Msg("failed to sweep thumbnails")
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			s.pruneThumbnails(filepath.Join(s.opts.ThumbnailDir, entry.Name()))
+		}
+	}
+}
+
+// Drops the cached thumbnails of a file after it was deleted or moved, if thumbnails are enabled.
+// Thumbnails of the files in a directory are left to the next sweep.
+func (s *Server) pruneThumbnailsOf(filePath string) {
+	if s.opts.ThumbnailDir != "" {
+		s.pruneThumbnails(s.thumbnailCacheDir(filePath))
+	}
+}
+
+// Removes the thumbnails in a cache directory that don't match the current version of their image,
+// or the whole directory if the image is gone.
+func (s *Server) pruneThumbnails(cacheDir string) {
+	source, err := os.ReadFile(filepath.Join(cacheDir, thumbnailSourceFile))
+	if err != nil {
+		return
+	}
+	info, err := s.stat(string(source))
+	if os.IsNotExist(err) {
+		if err := os.RemoveAll(cacheDir); err != nil {
+			s.opts.Logger.Warn().Err(err).Str("path", cacheDir).Msg("failed to remove thumbnails")
+		}
+		return
+	} else if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	version := thumbnailVersion(info) + "-"
+	for _, entry := range entries {
+		if entry.Name() != thumbnailSourceFile && !strings.HasPrefix(entry.Name(), version) &&
+			!strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			os.Remove(filepath.Join(cacheDir, entry.Name()))
+		}
+	}
+}
+
+// Scales an image down to fit in a square of the given size, keeping its aspect ratio.
+func scaleDown(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width > height {
+			width, height = size, height*size/width
+		} else {
+			width, height = width*size/height, size
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// Rotates and flips an image so it appears upright, according to its EXIF orientation.
+func orient(img *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if orientation >= 5 {
+		// the image is turned on its side
+		dst = image.NewNRGBA(image.Rect(0, 0, height, width))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], img.Pix[img.PixOffset(x, y):])
+		}
+	}
+	return dst
+}
+
+// Returns the EXIF orientation of a JPEG or WebP image, from 1 to 8, or 1 if it has none.
+func exifOrientation(file io.ReadSeeker, format string) int {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 1
+	}
+	switch format {
+	case "jpeg":
+		return tiffOrientation(jpegExif(bufio.NewReader(file)))
+	case "webp":
+		return tiffOrientation(webpExif(file))
+	}
+	return 1
+}
+
+// Returns the TIFF structure of the EXIF segment of a JPEG image, which comes before the image data.
+func jpegExif(r io.Reader) []byte {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return nil
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF || marker[1] == 0xDA {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+	}
+}
+
+// Returns the TIFF structure of the EXIF chunk of a WebP image, which usually comes after the image data.
+func webpExif(r io.ReadSeeker) []byte {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return nil
+	}
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil
+		}
+		length := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if string(chunk[:4]) == "EXIF" {
+			if length > 1<<20 {
+				return nil
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil
+			}
+			return bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+		}
+		// chunks are padded to an even length
+		if _, err := r.Seek(length+length&1, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+// Returns the orientation tag of the first directory of a TIFF structure, or 1 if it has none.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int64(order.Uint32(tiff[4:]))
+	if offset+2 > int64(len(tiff)) {
+		return 1
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,151 @@
+package gosses
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Encodes a JPEG with the left half red and the right half blue, tagged with an EXIF orientation.
+func orientedJPEG(t *testing.T, width int, height int, orientation byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	dieMaybe(t, jpeg.Encode(&buf, img, nil))
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	tiff[19] = orientation
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1, 0, byte(len(segment) + 2)}, segment...)
+	data := buf.Bytes()
+	return append(append(data[:2:2], app1...), data[2:]...)
+}
+
+func getThumbnail(t *testing.T, url string) (image.Image, *http.Response) {
+	resp, err := http.Get(url)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, resp
+	}
+	img, _, err := image.Decode(resp.Body)
+	dieMaybe(t, err)
+	return img, resp
+}
+
+func isReddish(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
+
+func TestThumbnail(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "photo.jpg"), orientedJPEG(t, 400, 200, 6), 0644))
+	var buf bytes.Buffer
+	dieMaybe(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 300, 100))))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "wide.png"), buf.Bytes(), 0644))
+	buf.Reset()
+	dieMaybe(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+	small := buf.Bytes()
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "small.png"), small, 0644))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "notes.txt"), []byte("not an image"), 0644))
+	cacheDir := filepath.Join(t.TempDir(), "thumbnails")
+	server, err := New(Options{Root: scratch, ThumbnailDir: cacheDir})
+	dieMaybe(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	url := ts.URL + "/"
+
+	fmt.Println("========== testing thumbnail orientation ============")
+	img, resp := getThumbnail(t, url+"thumbnail?path=%2Fphoto.jpg&size=128")
+	if img == nil || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatal("no jpeg thumbnail", resp.Status)
+	}
+	// rotated a quarter turn clockwise, so the red left half ends up on top
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 128 {
+		t.Fatal("wrong size", img.Bounds())
+	}
+	if !isReddish(img.At(32, 16)) || isReddish(img.At(32, 112)) {
+		t.Fatal("not rotated", img.At(32, 16), img.At(32, 112))
+	}
+
+	fmt.Println("========== testing thumbnail formats ============")
+	img, resp = getThumbnail(t, url+"thumbnail?path=%2Fwide.png")
+	if img == nil || resp.Header.Get("Content-Type") != "image/png" || img.Bounds().Dx() != 256 || img.Bounds().Dy() != 85 {
+		t.Fatal("wrong png thumbnail", resp.Status)
+	}
+	if body := getRaw(t, url+"thumbnail?path=%2Fsmall.png&size=64"); !bytes.Equal(body, small) {
+		t.Fatal("small image not served as is")
+	}
+	if _, resp = getThumbnail(t, url+"thumbnail?path=%2Fnotes.txt"); resp.StatusCode != 415 {
+		t.Fatal("text thumbnailed", resp.Status)
+	}
+	if _, resp = getThumbnail(t, url+"thumbnail?path=%2Fphoto.jpg&size=100"); resp.StatusCode != 400 {
+		t.Fatal("arbitrary size accepted", resp.Status)
+	}
+	if _, resp = getThumbnail(t, url+"thumbnail?path=%2Fmissing.jpg"); resp.StatusCode != 404 {
+		t.Fatal("missing image found", resp.Status)
+	}
+
+	fmt.Println("========== testing thumbnail cache ============")
+	entries, err := os.ReadDir(cacheDir)
+	dieMaybe(t, err)
+	if len(entries) != 2 {
+		t.Fatal("wrong cache entries", len(entries))
+	}
+	photoCache := server.thumbnailCacheDir(filepath.Join(scratch, "photo.jpg"))
+	if thumbnails, _ := filepath.Glob(filepath.Join(photoCache, "*.jpg")); len(thumbnails) != 1 {
+		t.Fatal("photo thumbnail not cached", thumbnails)
+	}
+	// a new version of the photo replaces the thumbnails of the old one
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "photo.jpg"), orientedJPEG(t, 200, 400, 1), 0644))
+	later := time.Now().Add(time.Minute)
+	dieMaybe(t, os.Chtimes(filepath.Join(scratch, "photo.jpg"), later, later))
+	if img, _ = getThumbnail(t, url+"thumbnail?path=%2Fphoto.jpg&size=128"); img == nil || img.Bounds().Dx() != 64 {
+		t.Fatal("stale thumbnail")
+	}
+	if thumbnails, _ := filepath.Glob(filepath.Join(photoCache, "*.jpg")); len(thumbnails) != 1 {
+		t.Fatal("old thumbnail kept", thumbnails)
+	}
+	if postJSON(t, url+"rpc", `{"call":"rm","args":["/photo.jpg"]}`) != `ok` {
+		t.Fatal("rm failed")
+	}
+	if _, err := os.Stat(photoCache); !os.IsNotExist(err) {
+		t.Fatal("thumbnails of removed photo kept")
+	}
+	dieMaybe(t, os.Remove(filepath.Join(scratch, "wide.png")))
+	server.sweepThumbnails()
+	if entries, _ = os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Fatal("thumbnails of deleted image kept", len(entries))
+	}
+	dieMaybe(t, server.Close())
+
+	if _, err := New(Options{Root: scratch, ThumbnailDir: filepath.Join(scratch, "cache")}); err == nil {
+		t.Fatal("shared thumbnail directory accepted")
+	}
+	goroutines := runtime.NumGoroutine()
+	opts := Options{Root: scratch, IndexDir: t.TempDir(), ThumbnailDir: filepath.Join(scratch, "cache")}
+	if _, err := New(opts); err == nil {
+		t.Fatal("shared thumbnail directory accepted")
+	}
+	if runtime.NumGoroutine() > goroutines {
+		t.Fatal("background work left running by a failed New")
+	}
+}
@@ -0,0 +1,348 @@
+package gosses
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Implements the core protocol and the creation and termination extensions of tus 1.0.
+// See https://tus.io/protocols/resumable-upload.html.
+const tusVersion = "1.0.0"
+
+// Metadata of a resumable upload, stored next to its partial data in the staging directory.
+type tusUpload struct {
+	// Total size in bytes.
+	Length int64 `json:"length"`
+	// Destination as sent by the client, resolved again on completion.
+	Path string `json:"path"`
+	// The user who created the upload, empty without authentication.
+	User string `json:"user"`
+	// What to do if the destination exists once the upload is complete.
+	Conflict ConflictPolicy `json:"conflict"`
+}
+
+// Adds the tus routes to group.
+func (s *Server) addTusRoutes(group *echo.Group) {
+	upload := []echo.MiddlewareFunc{s.tusChecker, s.authChecker, s.readOnlyChecker, s.permissionChecker(PermUpload)}
+	group.OPTIONS("tus/", s.handleTusOptions)
+	group.POST("tus/", s.handleTusCreate, upload...)
+	group.HEAD("tus/:id", s.handleTusHead, upload...)
+	group.PATCH("tus/:id", s.handleTusPatch, upload...)
+	group.DELETE("tus/:id", s.handleTusDelete, upload...)
+}
+
+// Rejects requests for unsupported protocol versions and tags all responses with the version in use.
+func (s *Server) tusChecker(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Tus-Resumable", tusVersion)
+		if c.Request().Header.Get("Tus-Resumable") != tusVersion {
+			c.Response().Header().Set("Tus-Version", tusVersion)
+			return c.String(412, "error")
+		}
+		return handlerFunc(c)
+	}
+}
+
+// Advertises the supported protocol version and extensions.
+func (s *Server) handleTusOptions(c echo.Context) error {
+	header := c.Response().Header()
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Tus-Version", tusVersion)
+	header.Set("Tus-Extension", "creation,termination")
+	if s.opts.MaxUploadSize > 0 {
+		header.Set("Tus-Max-Size", strconv.FormatInt(s.opts.MaxUploadSize, 10))
+	}
+	return c.NoContent(204)
+}
+
+// Creates an upload. The destination is passed in the 'path' metadata, the same as the gossa-path header.
+// The conflict policy is taken from the request creating the upload.
+func (s *Server) handleTusCreate(c echo.Context) error {
+	policy, err := s.conflictPolicy(c)
+	if err != nil {
+		return err
+	}
+	length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.String(400, "error")
+	}
+	metadata := parseTusMetadata(c.Request().Header.Get("Upload-Metadata"))
+	upload := tusUpload{Length: length, Path: metadata["path"], Conflict: policy}
+	if upload.Path == "" {
+		return c.String(400, "error")
+	}
+	if username, ok := c.Get("user").(string); ok {
+		upload.User = username
+	}
+	// fail early instead of after the whole file has been sent
+	dstPath, mount, err := s.resolvePath(c, upload.Path)
+	if err != nil {
+		return err
+	}
+	if !s.writable(mount) || dstPath == mount.Path {
+		return c.String(403, "error")
+	}
+	if policy == ConflictReject {
+		if _, err := s.storage.Lstat(dstPath); err == nil {
+			return errConflict
+		}
+	}
+	if err := s.checkUploadLimits(filepath.Dir(dstPath), length); err != nil {
+		return err
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(idBytes)
+	if err := os.MkdirAll(s.opts.StagingDir, 0700); err != nil {
+		return err
+	}
+	if err := s.checkStagingLimits(length); err != nil {
+		return err
+	}
+	info, err := json.Marshal(&upload)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.tusPath(id, ".json"), info, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.tusPath(id, ".bin"), nil, 0600); err != nil {
+		return err
+	}
+	if length == 0 {
+		if err := s.finishTusUpload(c, id, &upload); err != nil {
+			return err
+		}
+	}
+	c.Response().Header().Set(echo.HeaderLocation, s.opts.Prefix+"tus/"+id)
+	return c.NoContent(201)
+}
+
+// Reports how much of an upload has been received.
+func (s *Server) handleTusHead(c echo.Context) error {
+	id := c.Param("id")
+	upload, err := s.loadTusUpload(c, id)
+	if err != nil {
+		return c.NoContent(404)
+	}
+	stat, err := os.Stat(s.tusPath(id, ".bin"))
+	if err != nil {
+		return c.NoContent(404)
+	}
+	header := c.Response().Header()
+	header.Set("Upload-Offset", strconv.FormatInt(stat.Size(), 10))
+	header.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	header.Set(echo.HeaderCacheControl, "no-store")
+	return c.NoContent(200)
+}
+
+// Appends a chunk to an upload, moving it to its destination once complete.
+// Data received before a dropped connection is kept, so the client can resume from there.
+func (s *Server) handleTusPatch(c echo.Context) error {
+	if c.Request().Header.Get(echo.HeaderContentType) != "application/offset+octet-stream" {
+		return c.String(415, "error")
+	}
+	id := c.Param("id")
+	upload, err := s.loadTusUpload(c, id)
+	if err != nil {
+		return c.String(404, "error")
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return c.String(400, "error")
+	}
+	unlock, ok := s.lockTusUpload(id)
+	if !ok {
+		return c.String(423, "error")
+	}
+	defer unlock()
+	file, err := os.OpenFile(s.tusPath(id, ".bin"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return c.String(404, "error")
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != offset {
+		return c.String(409, "error")
+	}
+	written, err := io.Copy(file, io.LimitReader(c.Request().Body, upload.Length-offset))
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	offset += written
+	if offset == upload.Length {
+		if err := s.finishTusUpload(c, id, upload); err != nil {
+			return err
+		}
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	return c.NoContent(204)
+}
+
+// Terminates an upload, discarding its partial data.
+func (s *Server) handleTusDelete(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := s.loadTusUpload(c, id); err != nil {
+		return c.String(404, "error")
+	}
+	unlock, ok := s.lockTusUpload(id)
+	if !ok {
+		return c.String(423, "error")
+	}
+	defer unlock()
+	os.Remove(s.tusPath(id, ".bin"))
+	os.Remove(s.tusPath(id, ".json"))
+	return c.NoContent(204)
+}
+
+// Moves a complete upload from the staging directory to its destination according to its conflict policy.
+// The path it was stored at is returned in the gossa-path header, like for other uploads.
+func (s *Server) finishTusUpload(c echo.Context, id string, upload *tusUpload) error {
+	dstPath, mount, err := s.resolvePath(c, upload.Path)
+	if err != nil {
+		return err
+	}
+	if !s.writable(mount) {
+		return errors.New("upload destination is read-only")
+	}
+	policy := upload.Conflict
+	if policy == "" {
+		policy = s.opts.Conflict
+	}
+	storedPath, err := s.moveIntoShare(s.tusPath(id, ".bin"), dstPath, policy)
+	if err != nil {
+		return err
+	}
+	s.indexChanged(storedPath)
+	c.Response().Header().Set("gossa-path", url.PathEscape(s.storedVirtualPath(upload.Path, storedPath)))
+	return os.Remove(s.tusPath(id, ".json"))
+}
+
+// Loads the metadata of an upload, which only its creator may access.
+func (s *Server) loadTusUpload(c echo.Context, id string) (*tusUpload, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, errors.New("invalid upload id")
+	}
+	data, err := os.ReadFile(s.tusPath(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	username, _ := c.Get("user").(string)
+	if upload.User != username {
+		return nil, errors.New("upload of another user")
+	}
+	return &upload, nil
+}
+
+// Prevents concurrent writes to the same upload.
+// Returns false if the upload is already locked, otherwise a function to unlock it.
+func (s *Server) lockTusUpload(id string) (func(), bool) {
+	s.tusMu.Lock()
+	defer s.tusMu.Unlock()
+	if s.tusLocks[id] {
+		return nil, false
+	}
+	s.tusLocks[id] = true
+	return func() {
+		s.tusMu.Lock()
+		defer s.tusMu.Unlock()
+		delete(s.tusLocks, id)
+	}, true
+}
+
+func (s *Server) tusPath(id string, ext string) string {
+	return filepath.Join(s.opts.StagingDir, id+ext)
+}
+
+// Parses the Upload-Metadata header, a comma-separated list of keys and base64 encoded values.
+func parseTusMetadata(header string) map[string]string {
+	result := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 1 {
+			result[parts[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		result[parts[0]] = string(value)
+	}
+	return result
+}
+
+// Moves a local file into the share at dstPath, or another path according to policy, and returns where it went.
+// Falls back to copying if the storage can't move it from the local filesystem, e.g. across filesystems.
+func (s *Server) moveIntoShare(srcPath string, dstPath string, policy ConflictPolicy) (string, error) {
+	if renamer, ok := s.storage.(LocalRenamer); ok {
+		if err := syncStagedFile(srcPath, uploadMode(s.storage, dstPath)); err != nil {
+			return "", err
+		}
+		storedPath, err := s.placeFinished(srcPath, dstPath, policy, renamer.RenameFrom)
+		if err == nil || errors.Is(err, errConflict) {
+			return storedPath, err
+		}
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	var storedPath string
+	err = writeAtomic(s.storage, dstPath, func(dst File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}, func(tempPath string) error {
+		storedPath, err = s.placeFinished(tempPath, dstPath, policy, s.storage.Rename)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	src.Close()
+	return storedPath, os.Remove(srcPath)
+}
+
+// Prepares a staged file to be renamed into the share like writeAtomic does with its temporary files,
+// giving it mode and flushing it to disk.
+func syncStagedFile(srcPath string, mode fs.FileMode) error {
+	file, err := os.OpenFile(srcPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Chmod(mode); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
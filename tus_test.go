@@ -0,0 +1,156 @@
+package gosses
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tusRequest(t *testing.T, method string, url string, body []byte, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	dieMaybe(t, err)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestTus(t *testing.T) {
+	scratch := t.TempDir()
+	opts := Options{Root: scratch, StagingDir: filepath.Join(t.TempDir(), "staging")}
+	fmt.Println("========== testing resumable uploads ============")
+	autoServe(t, opts, func(url string) {
+		resp := tusRequest(t, "OPTIONS", url+"/tus/", nil, nil)
+		if resp.StatusCode != 204 || !strings.Contains(resp.Header.Get("Tus-Extension"), "creation") {
+			t.Fatal("options failed", resp.StatusCode)
+		}
+
+		payload := []byte("hello resumable world")
+		metadata := "path " + base64.StdEncoding.EncodeToString([]byte("/하 하.txt"))
+		resp = tusRequest(t, "POST", url+"/tus/", nil, map[string]string{
+			"Upload-Length":   fmt.Sprint(len(payload)),
+			"Upload-Metadata": metadata,
+		})
+		location := resp.Header.Get("Location")
+		if resp.StatusCode != 201 || !strings.HasPrefix(location, "/tus/") {
+			t.Fatal("create failed", resp.StatusCode, location)
+		}
+
+		patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+		resp = tusRequest(t, "PATCH", url+location, payload[:5], patch)
+		if resp.StatusCode != 204 || resp.Header.Get("Upload-Offset") != "5" {
+			t.Fatal("first chunk failed", resp.StatusCode)
+		}
+		if _, err := os.Stat(filepath.Join(scratch, "하 하.txt")); err == nil {
+			t.Fatal("incomplete upload visible")
+		}
+
+		resp = tusRequest(t, "PATCH", url+location, payload[5:], patch)
+		if resp.StatusCode != 409 {
+			t.Fatal("wrong offset accepted", resp.StatusCode)
+		}
+
+		resp = tusRequest(t, "HEAD", url+location, nil, nil)
+		if resp.StatusCode != 200 || resp.Header.Get("Upload-Offset") != "5" {
+			t.Fatal("head failed", resp.StatusCode)
+		}
+
+		patch["Upload-Offset"] = "5"
+		resp = tusRequest(t, "PATCH", url+location, payload[5:], patch)
+		if resp.StatusCode != 204 || resp.Header.Get("Upload-Offset") != fmt.Sprint(len(payload)) {
+			t.Fatal("last chunk failed", resp.StatusCode)
+		}
+		data, err := os.ReadFile(filepath.Join(scratch, "하 하.txt"))
+		dieMaybe(t, err)
+		if !bytes.Equal(data, payload) {
+			t.Fatal("upload corrupted", string(data))
+		}
+		if info, err := os.Stat(filepath.Join(scratch, "하 하.txt")); err != nil || info.Mode().Perm() != 0644 {
+			t.Fatal("upload kept the mode of the staging file", info, err)
+		}
+		if resp = tusRequest(t, "HEAD", url+location, nil, nil); resp.StatusCode != 404 {
+			t.Fatal("finished upload still staged", resp.StatusCode)
+		}
+
+		resp = tusRequest(t, "POST", url+"/tus/", nil, map[string]string{
+			"Upload-Length":   "100",
+			"Upload-Metadata": metadata,
+		})
+		location = resp.Header.Get("Location")
+		if resp = tusRequest(t, "DELETE", url+location, nil, nil); resp.StatusCode != 204 {
+			t.Fatal("termination failed", resp.StatusCode)
+		}
+		if resp = tusRequest(t, "HEAD", url+location, nil, nil); resp.StatusCode != 404 {
+			t.Fatal("terminated upload still staged", resp.StatusCode)
+		}
+
+		resp = tusRequest(t, "POST", url+"/tus/", nil, map[string]string{
+			"Upload-Length":   "1",
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte("/")),
+		})
+		if resp.StatusCode != 403 {
+			t.Fatal("upload to the shared directory itself accepted", resp.StatusCode)
+		}
+
+		req, err := http.NewRequest("POST", url+"/tus/", nil)
+		dieMaybe(t, err)
+		req.Header.Set("Upload-Length", "1")
+		resp, err = http.DefaultClient.Do(req)
+		dieMaybe(t, err)
+		if resp.StatusCode != 412 {
+			t.Fatal("missing protocol version accepted", resp.StatusCode)
+		}
+	})
+}
+
+func TestTusReadonly(t *testing.T) {
+	opts := Options{Root: t.TempDir(), StagingDir: t.TempDir(), ReadOnly: true}
+	autoServe(t, opts, func(url string) {
+		resp := tusRequest(t, "POST", url+"/tus/", nil, map[string]string{
+			"Upload-Length":   "1",
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte("/a")),
+		})
+		if resp.StatusCode != 403 {
+			t.Fatal("upload in read-only mode passed", resp.StatusCode)
+		}
+	})
+}
+
+// A Storage wrapping the local filesystem, which counts the uploads moved into it.
+type renameCountingStorage struct {
+	LocalStorage
+	renames int
+}
+
+func (s *renameCountingStorage) RenameFrom(localPath string, name string) error {
+	s.renames++
+	return s.LocalStorage.RenameFrom(localPath, name)
+}
+
+func TestTusWrappedStorage(t *testing.T) {
+	scratch := t.TempDir()
+	storage := &renameCountingStorage{}
+	opts := Options{Root: scratch, StagingDir: filepath.Join(t.TempDir(), "staging"), Storage: storage}
+	autoServe(t, opts, func(url string) {
+		resp := tusRequest(t, "POST", url+"/tus/", nil, map[string]string{
+			"Upload-Length":   "5",
+			"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte("/a.txt")),
+		})
+		patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+		if resp = tusRequest(t, "PATCH", url+resp.Header.Get("Location"), []byte("hello"), patch); resp.StatusCode != 204 {
+			t.Fatal("upload failed", resp.StatusCode)
+		}
+		if data, err := os.ReadFile(filepath.Join(scratch, "a.txt")); err != nil || string(data) != "hello" || storage.renames != 1 {
+			t.Fatal("upload not moved through the storage", string(data), err, storage.renames)
+		}
+	})
+}
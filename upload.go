@@ -0,0 +1,177 @@
+package gosses
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Outcome of one file of a multi-file upload.
+type uploadResult struct {
+	// Where the file was stored, which differs from the requested path if it was renamed to avoid a conflict.
+	Path  string `json:"path"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handles file uploads from the frontend.
+// With a gossa-path header, the first file is stored at that path. Otherwise every file is stored at its file name,
+// which may include directories, below the directory in the gossa-dir header, and the outcome is reported per file.
+func (s *Server) handleUpload(c echo.Context) error {
+	policy, err := s.conflictPolicy(c)
+	if err != nil {
+		return err
+	}
+	// the rest of the body bounds the size of each file, which is only known once it's read
+	body := &countingReader{ReadCloser: c.Request().Body}
+	c.Request().Body = body
+	reader, err := c.Request().MultipartReader()
+	if err != nil {
+		return err
+	}
+	if c.Request().Header.Get("gossa-path") != "" {
+		return s.handleSingleUpload(c, reader, policy)
+	}
+	dir, err := url.PathUnescape(c.Request().Header.Get("gossa-dir"))
+	if err != nil {
+		return err
+	}
+	results := []uploadResult{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fileName := partFileName(part)
+		if fileName == "" {
+			continue
+		}
+		virtualPath := path.Join("/", dir, fileName)
+		result := uploadResult{Path: s.storedVirtualPath(virtualPath, virtualPath), Ok: true}
+		maxSize := int64(-1)
+		if c.Request().ContentLength >= 0 {
+			maxSize = c.Request().ContentLength - body.read
+		}
+		if storedPath, err := s.storeUpload(c, virtualPath, part, -1, maxSize, policy); err == nil {
+			result.Path = storedPath
+		} else {
+			result.Ok = false
+			result.Error = "error"
+			if httpErr, ok := err.(*echo.HTTPError); ok && httpErr.Code != 403 {
+				result.Error = fmt.Sprint(httpErr.Message)
+			}
+			s.opts.Logger.Warn().Err(err).Str("path", result.Path).Msg("upload failed")
+		}
+		results = append(results, result)
+	}
+	return c.JSON(200, results)
+}
+
+// Stores the first file of a request at the path in the gossa-path header.
+// The path it was stored at is returned in the same header.
+func (s *Server) handleSingleUpload(c echo.Context, reader *multipart.Reader, policy ConflictPolicy) error {
+	unescapedPath, err := url.PathUnescape(c.Request().Header.Get("gossa-path"))
+	if err != nil {
+		return err
+	}
+	// the multipart framing is not part of the file
+	size := c.Request().ContentLength
+	if size > multipartOverhead {
+		size -= multipartOverhead
+	} else if size > 0 {
+		size = 0
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		return err
+	}
+	storedPath, err := s.storeUpload(c, unescapedPath, part, size, size, policy)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("gossa-path", url.PathEscape(storedPath))
+	return c.String(200, "ok")
+}
+
+// Writes an uploaded file of size bytes, or -1 if unknown, to a virtual path, creating missing parent directories
+// if the user may create directories. The free space is checked for maxSize bytes if only that bound of the size is
+// known, or while writing if it is -1 too.
+// Returns the path the file was stored at according to policy, as reported by storedVirtualPath.
+func (s *Server) storeUpload(c echo.Context, virtualPath string, src io.Reader, size int64, maxSize int64,
+	policy ConflictPolicy) (string, error) {
+	dstPath, mount, err := s.resolvePath(c, virtualPath)
+	if err != nil {
+		return "", err
+	}
+	if !s.writable(mount) || dstPath == mount.Path {
+		return "", echo.NewHTTPError(403, "error")
+	}
+	// fail early instead of after the whole file has been sent
+	if policy == ConflictReject {
+		if _, err := s.storage.Lstat(dstPath); err == nil {
+			return "", errConflict
+		}
+	}
+	dir := filepath.Dir(dstPath)
+	// missing directories are only created once the upload is accepted
+	limitsDir := dir
+	if _, err := s.storage.Stat(dir); err != nil {
+		if !s.hasPermission(c, PermMkdir) {
+			return "", errForbidden
+		}
+		limitsDir = mount.Path
+	}
+	if err := s.checkUploadLimits(limitsDir, size); err != nil {
+		return "", err
+	}
+	if size < 0 && maxSize >= 0 {
+		if err := s.checkFreeSpace(s.storage, limitsDir, maxSize); err != nil {
+			return "", err
+		}
+	}
+	if err := s.storage.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	storedPath := dstPath
+	err = writeAtomic(s.storage, dstPath, func(dstFile File) error {
+		var dst io.Writer = dstFile
+		if size < 0 && maxSize < 0 {
+			dst = &freeSpaceWriter{s: s, writer: dstFile, dir: dir}
+		}
+		_, err := s.copyUpload(dst, src)
+		return err
+	}, func(tempPath string) error {
+		storedPath, err = s.placeFinished(tempPath, dstPath, policy, s.storage.Rename)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	s.indexChanged(storedPath)
+	return s.storedVirtualPath(virtualPath, storedPath), nil
+}
+
+// Returns the path reported to clients for a file stored at storedPath by an upload to virtualPath. It includes the
+// prefix like the paths clients upload to, so it can be passed back as is.
+func (s *Server) storedVirtualPath(virtualPath string, storedPath string) string {
+	dir := path.Dir(filepath.ToSlash(s.cleanPath(virtualPath)))
+	return path.Join(s.opts.Prefix, dir, filepath.Base(storedPath))
+}
+
+// Returns the file name of a part including its directories, which Part.FileName strips away.
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
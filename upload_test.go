@@ -0,0 +1,73 @@
+package gosses
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func postFiles(t *testing.T, endpoint string, dir string, files [][2]string) []uploadResult {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for _, file := range files {
+		fileWriter, err := w.CreateFormFile("file", file[0])
+		dieMaybe(t, err)
+		_, err = fileWriter.Write([]byte(file[1]))
+		dieMaybe(t, err)
+	}
+	dieMaybe(t, w.Close())
+	req, err := http.NewRequest("POST", endpoint, &b)
+	dieMaybe(t, err)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Gossa-Dir", dir)
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	var results []uploadResult
+	dieMaybe(t, json.NewDecoder(resp.Body).Decode(&results))
+	return results
+}
+
+func TestMultiUpload(t *testing.T) {
+	scratch := t.TempDir()
+	opts := Options{Root: scratch, MaxUploadSize: 10}
+	fmt.Println("========== testing multi-file uploads ============")
+	autoServe(t, opts, func(url string) {
+		url += "/"
+		results := postFiles(t, url+"post", "%2Fdrop", [][2]string{
+			{"tree/a.txt", "a"},
+			{"tree/sub/b.txt", "b"},
+			{"large.txt", "more than ten bytes"},
+			{"../../c.txt", "c"},
+		})
+		if len(results) != 4 {
+			t.Fatal("expected four results", results)
+		}
+		if !results[0].Ok || results[0].Path != "/drop/tree/a.txt" || !results[1].Ok {
+			t.Fatal("folder upload failed", results)
+		}
+		if results[2].Ok || results[2].Error == "" {
+			t.Fatal("upload over limit passed", results[2])
+		}
+		if !results[3].Ok || results[3].Path != "/c.txt" {
+			t.Fatal("upload outside of directory not contained", results[3])
+		}
+		data, err := os.ReadFile(filepath.Join(scratch, "drop", "tree", "sub", "b.txt"))
+		dieMaybe(t, err)
+		if string(data) != "b" {
+			t.Fatal("upload corrupted", string(data))
+		}
+		if _, err := os.Stat(filepath.Join(scratch, "drop", "large.txt")); err == nil {
+			t.Fatal("failed upload kept")
+		}
+
+		if postDummyFile(t, url, "%2Fnew%2Fdeep%2Fd.txt", "d") != `ok` || get(t, url+"new/deep/d.txt") != `d` {
+			t.Fatal("upload into missing directory failed")
+		}
+	})
+}
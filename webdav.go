@@ -0,0 +1,390 @@
+package gosses
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The permission required by each WebDAV method. Others only need PermRead. Locking a missing file creates it.
+var davPermissions = map[string]Permission{
+	http.MethodPut:    PermUpload,
+	"COPY":            PermUpload,
+	"PROPPATCH":       PermUpload,
+	"LOCK":            PermUpload,
+	"MKCOL":           PermMkdir,
+	"MOVE":            PermMv,
+	http.MethodDelete: PermRm,
+}
+
+// The state of a WebDAV request, passed to davFS through the request context.
+type davRequest struct {
+	c echo.Context
+	// Why reading the body of a PUT request failed, so the partial file isn't kept.
+	bodyErr error
+}
+
+type davRequestKey struct{}
+
+// Serves the share over WebDAV, going through the same path resolution, hidden file skipping and symlink policy
+// as the web UI. Implements webdav.FileSystem.
+type davFS struct {
+	s *Server
+}
+
+func (s *Server) newWebDAV() *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     s.davPrefix(),
+		FileSystem: davFS{s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				s.opts.Logger.Debug().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("webdav")
+			}
+		},
+	}
+}
+
+func (s *Server) davPrefix() string {
+	return s.opts.Prefix + s.opts.WebDAV
+}
+
+// Returns the path of a request below the WebDAV endpoint, relative to it.
+func (s *Server) davPath(urlPath string) (string, bool) {
+	prefix := s.davPrefix()
+	if urlPath == prefix {
+		return "/", true
+	}
+	if strings.HasPrefix(urlPath, prefix+"/") {
+		return urlPath[len(prefix):], true
+	}
+	return "", false
+}
+
+// Routes requests below the WebDAV endpoint to handleWebDAV, with authentication and logging.
+// They have to bypass the router, which doesn't know methods like MKCOL.
+func (s *Server) davRouter(logging echo.MiddlewareFunc) echo.MiddlewareFunc {
+	handler := logging(s.authChecker(s.handleWebDAV))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := s.davPath(c.Request().URL.Path); ok {
+				return handler(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// Handles a WebDAV request after checking the permissions of the current user for it.
+func (s *Server) handleWebDAV(c echo.Context) error {
+	r := c.Request()
+	perm, ok := davPermissions[r.Method]
+	if !ok {
+		perm = PermRead
+	}
+	if !s.hasPermission(c, perm) {
+		return errForbidden
+	}
+	targets := []string{r.URL.Path}
+	if destination, err := url.Parse(r.Header.Get("Destination")); err == nil && destination.Path != "" {
+		targets = append(targets, destination.Path)
+	}
+	for i, target := range targets {
+		davPath, ok := s.davPath(target)
+		if !ok {
+			// the WebDAV handler rejects foreign destinations
+			continue
+		}
+		filePath, mount, err := s.resolveSharePath(c, davPath)
+		if err != nil || mount == nil {
+			continue
+		}
+		// the source of a copy is only read
+		if perm&permWrite != 0 && (r.Method != "COPY" || i > 0) && !s.writable(mount) {
+			return errForbidden
+		}
+		if i > 0 {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			s.setCustomContentType(c, filePath)
+		case http.MethodPut:
+			dir := filepath.Dir(filePath)
+			if _, err := s.storage.Stat(dir); err != nil {
+				dir = mount.Path
+			}
+			if err := s.checkUploadLimits(dir, r.ContentLength); err != nil {
+				return err
+			}
+		}
+	}
+	req := &davRequest{c: c}
+	r = r.WithContext(context.WithValue(r.Context(), davRequestKey{}, req))
+	if r.Method == http.MethodPut {
+		r.Body = &davBody{ReadCloser: r.Body, req: req, s: s}
+	}
+	s.webdav.ServeHTTP(c.Response(), r)
+	return nil
+}
+
+// The body of a PUT request. Records why reading it failed, as the WebDAV handler closes the file regardless.
+type davBody struct {
+	io.ReadCloser
+	req  *davRequest
+	s    *Server
+	read int64
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.s.opts.MaxUploadSize > 0 && b.read > b.s.opts.MaxUploadSize {
+		err = b.s.errUploadTooLarge()
+	}
+	if err != nil && err != io.EOF {
+		b.req.bodyErr = err
+	}
+	return n, err
+}
+
+func (fsys davFS) resolve(ctx context.Context, name string) (*davRequest, string, *Mount, error) {
+	req := ctx.Value(davRequestKey{}).(*davRequest)
+	filePath, mount, err := fsys.s.resolveSharePath(req.c, name)
+	return req, filePath, mount, err
+}
+
+func (fsys davFS) resolveWritable(ctx context.Context, name string, perm Permission) (*davRequest, string, error) {
+	req := ctx.Value(davRequestKey{}).(*davRequest)
+	filePath, err := fsys.s.resolveWritableSharePath(req.c, name, perm)
+	return req, filePath, err
+}
+
+func (fsys davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	_, filePath, err := fsys.resolveWritable(ctx, name, PermMkdir)
+	if err != nil {
+		return err
+	}
+	return fsys.s.storage.Mkdir(filePath, perm)
+}
+
+func (fsys davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return fsys.create(ctx, name, flag)
+	}
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	_, filePath, _, err := fsys.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &davDir{s: fsys.s, path: filePath, info: info}, nil
+	}
+	file, err := fsys.s.storage.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return davFile{file}, nil
+}
+
+// Opens a file to replace with what is written to it, once it is closed.
+// The WebDAV handler only ever truncates files it writes to.
+func (fsys davFS) create(ctx context.Context, name string, flag int) (webdav.File, error) {
+	req, filePath, err := fsys.resolveWritable(ctx, name, PermUpload)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := fsys.s.stat(filePath); err == nil {
+		if info.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+		if flag&os.O_EXCL != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+	}
+	if _, err := fsys.s.storage.Stat(filepath.Dir(filePath)); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	upload := &davUpload{s: fsys.s, req: req, path: filePath, writer: writer, done: make(chan error, 1)}
+	go func() {
+		err := writeAtomic(fsys.s.storage, filePath, func(file File) error {
+			_, err := io.Copy(file, reader)
+			return err
+		}, nil)
+		// fails writes if the file couldn't even be created
+		reader.CloseWithError(err)
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+func (fsys davFS) RemoveAll(ctx context.Context, name string) error {
+	_, filePath, err := fsys.resolveWritable(ctx, name, PermRm)
+	if err != nil {
+		return err
+	}
+	if err := fsys.s.storage.RemoveAll(filePath); err != nil {
+		return err
+	}
+	fsys.s.indexRemoved(filePath)
+	fsys.s.pruneThumbnailsOf(filePath)
+	return nil
+}
+
+func (fsys davFS) Rename(ctx context.Context, oldName, newName string) error {
+	_, oldPath, err := fsys.resolveWritable(ctx, oldName, PermMv)
+	if err != nil {
+		return err
+	}
+	_, newPath, err := fsys.resolveWritable(ctx, newName, PermMv)
+	if err != nil {
+		return err
+	}
+	if err := fsys.s.storage.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	fsys.s.indexMoved(oldPath, newPath)
+	fsys.s.pruneThumbnailsOf(oldPath)
+	return nil
+}
+
+func (fsys davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, filePath, mount, err := fsys.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.s.statShared(filePath, mount)
+}
+
+// A file opened over WebDAV for reading.
+type davFile struct {
+	File
+}
+
+func (f davFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errNotDir
+}
+
+// A directory opened over WebDAV, listing the same entries as the web UI.
+type davDir struct {
+	s *Server
+	// Empty for the virtual root listing all mounts.
+	path    string
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	listed  bool
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read([]byte) (int, error) {
+	return 0, errIsDir
+}
+
+func (d *davDir) Seek(int64, int) (int64, error) {
+	return 0, nil
+}
+
+func (d *davDir) Write([]byte) (int, error) {
+	return 0, errIsDir
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.s.listShared(d.path)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.listed = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// A file being uploaded over WebDAV. It's written atomically like uploads from the web UI,
+// and only replaces the target once complete.
+type davUpload struct {
+	s      *Server
+	req    *davRequest
+	path   string
+	writer *io.PipeWriter
+	done   chan error
+	// Set once the upload is complete, with its outcome.
+	finished bool
+	err      error
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	if u.finished {
+		return 0, fs.ErrClosed
+	}
+	return u.writer.Write(p)
+}
+
+// Stat completes the upload, as the WebDAV handler asks for the attributes of the final file before closing it.
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	if err := u.finish(); err != nil {
+		return nil, err
+	}
+	return u.s.stat(u.path)
+}
+
+func (u *davUpload) Close() error {
+	return u.finish()
+}
+
+func (u *davUpload) finish() error {
+	if u.finished {
+		return u.err
+	}
+	u.finished = true
+	// a failed body leaves the target as it was
+	u.writer.CloseWithError(u.req.bodyErr)
+	if u.err = <-u.done; u.err == nil {
+		u.s.indexChanged(u.path)
+	}
+	return u.err
+}
+
+func (u *davUpload) Read([]byte) (int, error) {
+	return 0, errors.New("file is open for writing")
+}
+
+func (u *davUpload) Seek(int64, int) (int64, error) {
+	return 0, errors.New("file is open for writing")
+}
+
+func (u *davUpload) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errNotDir
+}
@@ -0,0 +1,131 @@
+package gosses
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func dav(t *testing.T, method string, url string, headers map[string]string, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	dieMaybe(t, err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	dieMaybe(t, err)
+	return resp.StatusCode, string(bodyBytes)
+}
+
+func TestWebDAV(t *testing.T) {
+	scratch := t.TempDir()
+	dieMaybe(t, os.MkdirAll(filepath.Join(scratch, ".hidden"), 0755))
+	dieMaybe(t, os.WriteFile(filepath.Join(scratch, "b.txt"), []byte("hello"), 0644))
+	server, err := New(Options{Root: scratch, SkipHidden: true, WebDAV: "/dav/", MaxUploadSize: 100})
+	dieMaybe(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	url := ts.URL + "/dav/"
+
+	fmt.Println("========== testing webdav listing ============")
+	code, body := dav(t, "PROPFIND", url, map[string]string{"Depth": "1"}, "")
+	if code != 207 || !strings.Contains(body, "<D:href>/dav/b.txt</D:href>") || strings.Contains(body, ".hidden") {
+		t.Fatal("wrong listing", code, body)
+	}
+	if code, body = dav(t, "GET", url+"b.txt", nil, ""); code != 200 || body != "hello" {
+		t.Fatal("wrong content", code, body)
+	}
+	if code, _ = dav(t, "PROPFIND", url+".hidden", map[string]string{"Depth": "0"}, ""); code != 404 {
+		t.Fatal("hidden directory found", code)
+	}
+
+	fmt.Println("========== testing webdav changes ============")
+	if code, _ = dav(t, "PUT", url+"new.txt", nil, "some content"); code != 201 {
+		t.Fatal("put failed", code)
+	}
+	if code, _ = dav(t, "MKCOL", url+"dir", nil, ""); code != 201 {
+		t.Fatal("mkcol failed", code)
+	}
+	if code, _ = dav(t, "COPY", url+"new.txt", map[string]string{"Destination": url + "dir/copy.txt"}, ""); code != 201 {
+		t.Fatal("copy failed", code)
+	}
+	if code, _ = dav(t, "MOVE", url+"dir/copy.txt", map[string]string{"Destination": url + "moved.txt"}, ""); code != 201 {
+		t.Fatal("move failed", code)
+	}
+	if content, _ := os.ReadFile(filepath.Join(scratch, "moved.txt")); string(content) != "some content" {
+		t.Fatal("wrong moved content", string(content))
+	}
+	if code, _ = dav(t, "DELETE", url+"new.txt", nil, ""); code != 204 {
+		t.Fatal("delete failed", code)
+	}
+	if _, err := os.Stat(filepath.Join(scratch, "new.txt")); !os.IsNotExist(err) {
+		t.Fatal("file not deleted")
+	}
+	lock := `<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype></D:lockinfo>`
+	if code, body = dav(t, "LOCK", url+"moved.txt", nil, lock); code != 200 || !strings.Contains(body, "<D:locktoken>") {
+		t.Fatal("lock failed", code, body)
+	}
+	if code, _ = dav(t, "PUT", url+"moved.txt", nil, "without the lock"); code != 423 {
+		t.Fatal("lock not enforced", code)
+	}
+
+	fmt.Println("========== testing webdav limits ============")
+	if code, _ = dav(t, "PUT", url+"big.txt", nil, strings.Repeat("a", 101)); code != 413 {
+		t.Fatal("upload limit not enforced", code)
+	}
+	// without a length, the upload fails while being written
+	req, err := http.NewRequest("PUT", url+"big.txt", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 101))))
+	dieMaybe(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	dieMaybe(t, err)
+	resp.Body.Close()
+	if _, err := os.Stat(filepath.Join(scratch, "big.txt")); resp.StatusCode < 400 || !os.IsNotExist(err) {
+		t.Fatal("partial upload kept", resp.StatusCode)
+	}
+	if code, _ = dav(t, "DELETE", url, nil, ""); code == 204 {
+		t.Fatal("share deleted")
+	}
+	if _, err := os.Stat(filepath.Join(scratch, "b.txt")); err != nil {
+		t.Fatal("share deleted")
+	}
+
+	fmt.Println("========== testing read-only webdav ============")
+	autoServe(t, Options{Mounts: []Mount{{Name: "docs", Path: scratch, ReadOnly: true}}, WebDAV: "dav"}, func(url string) {
+		code, body := dav(t, "PROPFIND", url+"/dav/", map[string]string{"Depth": "1"}, "")
+		if code != 207 || !strings.Contains(body, "<D:href>/dav/docs/</D:href>") {
+			t.Fatal("mounts not listed", code, body)
+		}
+		if code, _ = dav(t, "PUT", url+"/dav/docs/other.txt", nil, "content"); code != 403 {
+			t.Fatal("read-only mount written", code)
+		}
+		if code, _ = dav(t, "MOVE", url+"/dav/docs/b.txt", map[string]string{"Destination": url + "/dav/docs/c.txt"}, ""); code != 403 {
+			t.Fatal("read-only mount written", code)
+		}
+	})
+
+	fmt.Println("========== testing webdav permissions ============")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dieMaybe(t, err)
+	opts := Options{Root: scratch, WebDAV: "dav", Users: map[string][]byte{"bob": hash},
+		Profiles: map[string]Profile{"bob": {Perms: PermRead}}}
+	autoServe(t, opts, func(url string) {
+		req, err := http.NewRequest("LOCK", url+"/dav/created.txt", strings.NewReader(lock))
+		dieMaybe(t, err)
+		if code, _ := doWithAuth(t, req, "bob"); code != 403 {
+			t.Fatal("lock allowed without upload permission", code)
+		}
+		if _, err := os.Stat(filepath.Join(scratch, "created.txt")); !os.IsNotExist(err) {
+			t.Fatal("file created by lock")
+		}
+	})
+}